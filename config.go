@@ -0,0 +1,692 @@
+package orm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+	"xorm.io/core"
+)
+
+// 配置文件格式
+const (
+	ConfigYAML = "yaml"
+	ConfigJSON = "json"
+	ConfigTOML = "toml"
+)
+
+// 匹配 ${NAME} 以及 ${NAME:-default}
+var configEnvRegexp = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// 当前生效的配置以及由配置创建的xorm redis cache
+var configState struct {
+	sync.Mutex
+	config *Config
+	caches map[string]*xOrmRedisCache
+}
+
+// Config 描述任意数量的redis cache, gorm db, xorm engine以及xorm engine group
+type Config struct {
+	Redis      []RedisCacheConfig `json:"redis" yaml:"redis" toml:"redis"`
+	GOrm       []GOrmConfig       `json:"gorm" yaml:"gorm" toml:"gorm"`
+	XOrm       []XOrmConfig       `json:"xorm" yaml:"xorm" toml:"xorm"`
+	XOrmGroups []XOrmGroupConfig  `json:"xorm_groups" yaml:"xorm_groups" toml:"xorm_groups"`
+}
+
+type RedisCacheConfig struct {
+	Name       string   `json:"name" yaml:"name" toml:"name"`
+	Hosts      []string `json:"hosts" yaml:"hosts" toml:"hosts"`
+	Password   string   `json:"password" yaml:"password" toml:"password"`
+	DB         int      `json:"db" yaml:"db" toml:"db"`
+	Expiration Duration `json:"expiration" yaml:"expiration" toml:"expiration"`
+	Namespace  string   `json:"namespace" yaml:"namespace" toml:"namespace"` // key前缀, 多个服务共用同一个redis库时区分
+	Codec      string   `json:"codec" yaml:"codec" toml:"codec"`             // gob, json, msgpack, 仅用于xorm
+	Version    string   `json:"version" yaml:"version" toml:"version"`
+	Verify     bool     `json:"verify" yaml:"verify" toml:"verify"`
+	// 防击穿, 见XOrmRedisCacheSingleflight, XOrmRedisCacheLock, XOrmRedisCacheXFetch
+	Singleflight Duration `json:"singleflight" yaml:"singleflight" toml:"singleflight"`
+	Lock         Duration `json:"lock" yaml:"lock" toml:"lock"`
+	XFetch       float64  `json:"xfetch" yaml:"xfetch" toml:"xfetch"`
+	Negative     Duration `json:"negative" yaml:"negative" toml:"negative"` // 空结果的过期时间
+	// id列表的过期时间, 每张表单独的过期时间以及过期时间的随机增加比例, 见XOrmRedisCacheJitter
+	IdsExpiration Duration                         `json:"ids_expiration" yaml:"ids_expiration" toml:"ids_expiration"`
+	Tables        map[string]RedisCacheTableConfig `json:"tables" yaml:"tables" toml:"tables"`
+	Jitter        float64                          `json:"jitter" yaml:"jitter" toml:"jitter"`
+	// 每个redis操作的超时时间以及熔断, 见XOrmRedisCacheBreaker
+	Timeout         Duration `json:"timeout" yaml:"timeout" toml:"timeout"`
+	BreakerFailures int      `json:"breaker_failures" yaml:"breaker_failures" toml:"breaker_failures"`
+	BreakerCooldown Duration `json:"breaker_cooldown" yaml:"breaker_cooldown" toml:"breaker_cooldown"`
+	Generations     bool     `json:"generations" yaml:"generations" toml:"generations"` // 按表分代, 清除表时不再扫描key
+	// 压缩算法 snappy, zstd, gzip 以及压缩阈值(字节), 见XOrmRedisCacheCompression
+	Compression       string `json:"compression" yaml:"compression" toml:"compression"`
+	CompressThreshold int    `json:"compress_threshold" yaml:"compress_threshold" toml:"compress_threshold"`
+}
+
+type RedisCacheTableConfig struct {
+	Expiration    Duration `json:"expiration" yaml:"expiration" toml:"expiration"`
+	IdsExpiration Duration `json:"ids_expiration" yaml:"ids_expiration" toml:"ids_expiration"`
+}
+
+type GOrmConfig struct {
+	Name            string   `json:"name" yaml:"name" toml:"name"`
+	Driver          string   `json:"driver" yaml:"driver" toml:"driver"`
+	DataSource      string   `json:"data_source" yaml:"data_source" toml:"data_source"`
+	ShowSQL         bool     `json:"show_sql" yaml:"show_sql" toml:"show_sql"`
+	MaxIdleConn     int      `json:"max_idle_conn" yaml:"max_idle_conn" toml:"max_idle_conn"`
+	MaxOpenConn     int      `json:"max_open_conn" yaml:"max_open_conn" toml:"max_open_conn"`
+	ConnMaxLifetime Duration `json:"conn_max_lifetime" yaml:"conn_max_lifetime" toml:"conn_max_lifetime"`
+	RedisCache      string   `json:"redis_cache" yaml:"redis_cache" toml:"redis_cache"` // 对应Redis配置的name
+	// 读写分离从库
+	Replicas []GOrmReplicaConfig `json:"replicas" yaml:"replicas" toml:"replicas"`
+	Policy   string              `json:"policy" yaml:"policy" toml:"policy"` // random, least_conn, round_robin
+}
+
+type GOrmReplicaConfig struct {
+	DataSource string `json:"data_source" yaml:"data_source" toml:"data_source"`
+	Weight     int    `json:"weight" yaml:"weight" toml:"weight"`
+}
+
+type XOrmConfig struct {
+	Name               string            `json:"name" yaml:"name" toml:"name"`
+	Driver             string            `json:"driver" yaml:"driver" toml:"driver"`
+	DataSource         string            `json:"data_source" yaml:"data_source" toml:"data_source"`
+	MaxIdleConn        int               `json:"max_idle_conn" yaml:"max_idle_conn" toml:"max_idle_conn"`
+	MaxOpenConn        int               `json:"max_open_conn" yaml:"max_open_conn" toml:"max_open_conn"`
+	ConnMaxLifetime    Duration          `json:"conn_max_lifetime" yaml:"conn_max_lifetime" toml:"conn_max_lifetime"`
+	Schema             string            `json:"schema" yaml:"schema" toml:"schema"`
+	TZDatabase         string            `json:"tz_database" yaml:"tz_database" toml:"tz_database"`
+	TZLocation         string            `json:"tz_location" yaml:"tz_location" toml:"tz_location"`
+	ShowSQL            bool              `json:"show_sql" yaml:"show_sql" toml:"show_sql"`
+	ShowExecTime       bool              `json:"show_exec_time" yaml:"show_exec_time" toml:"show_exec_time"`
+	NoAutoTime         bool              `json:"no_auto_time" yaml:"no_auto_time" toml:"no_auto_time"`
+	BufferSize         int               `json:"buffer_size" yaml:"buffer_size" toml:"buffer_size"`
+	Charset            string            `json:"charset" yaml:"charset" toml:"charset"`
+	Cascade            bool              `json:"cascade" yaml:"cascade" toml:"cascade"`
+	Mapper             string            `json:"mapper" yaml:"mapper" toml:"mapper"` // same, snake, gonic
+	TableMapper        string            `json:"table_mapper" yaml:"table_mapper" toml:"table_mapper"`
+	ColumnMapper       string            `json:"column_mapper" yaml:"column_mapper" toml:"column_mapper"`
+	DisableGlobalCache bool              `json:"disable_global_cache" yaml:"disable_global_cache" toml:"disable_global_cache"`
+	DefaultCache       string            `json:"default_cache" yaml:"default_cache" toml:"default_cache"` // 对应Redis配置的name
+	Caches             map[string]string `json:"caches" yaml:"caches" toml:"caches"`                      // 表名 => 对应Redis配置的name
+}
+
+type XOrmGroupConfig struct {
+	Name   string            `json:"name" yaml:"name" toml:"name"`
+	Master string            `json:"master" yaml:"master" toml:"master"` // 对应XOrm配置的name
+	Slaves []XOrmSlaveConfig `json:"slaves" yaml:"slaves" toml:"slaves"`
+	Policy string            `json:"policy" yaml:"policy" toml:"policy"` // random, least_conn, round_robin, latency, zone_affinity, consistent_hash
+	Zone   string            `json:"zone" yaml:"zone" toml:"zone"`       // zone_affinity时当前进程的可用区
+	// 不可用slave探测间隔,为0时不探测
+	ProbeInterval Duration `json:"probe_interval" yaml:"probe_interval" toml:"probe_interval"`
+	// 最大复制延迟,为0时不检测
+	MaxReplicationLag Duration `json:"max_replication_lag" yaml:"max_replication_lag" toml:"max_replication_lag"`
+	LagHeartbeat      string   `json:"lag_heartbeat" yaml:"lag_heartbeat" toml:"lag_heartbeat"` // 心跳表名
+	// 写后读粘滞窗口
+	StickyWindow Duration `json:"sticky_window" yaml:"sticky_window" toml:"sticky_window"`
+}
+
+type XOrmSlaveConfig struct {
+	Engine string `json:"engine" yaml:"engine" toml:"engine"` // 对应XOrm配置的name
+	Weight int    `json:"weight" yaml:"weight" toml:"weight"`
+	Zone   string `json:"zone" yaml:"zone" toml:"zone"`
+}
+
+// Duration 支持 "60s", "1m30s" 形式的配置
+type Duration time.Duration
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	duration, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// LoadConfig 读取配置文件,根据扩展名(.yaml/.yml/.json/.toml)选择解析格式
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var format string
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		format = ConfigYAML
+	case ".json":
+		format = ConfigJSON
+	case ".toml":
+		format = ConfigTOML
+	default:
+		return nil, fmt.Errorf("not support config file:%s", path)
+	}
+	return ParseConfig(data, format)
+}
+
+// ParseConfig 按format解析后替换字符串字段中的环境变量
+// 环境变量的值不会再被解析, 可以包含引号, 冒号等字符; 非字符串字段(数字, 时长等)不支持环境变量
+func ParseConfig(data []byte, format string) (*Config, error) {
+	var err error
+	config := &Config{}
+	switch format {
+	case ConfigYAML:
+		err = yaml.Unmarshal(data, config)
+	case ConfigJSON:
+		err = json.Unmarshal(data, config)
+	case ConfigTOML:
+		err = toml.Unmarshal(data, config)
+	default:
+		return nil, fmt.Errorf("not support config format:%s", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = expandConfigEnv(reflect.ValueOf(config).Elem()); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// 递归替换v中所有字符串的环境变量, v需要可以设置
+func expandConfigEnv(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.String:
+		s, err := expandConfigEnvString(v.String())
+		if err != nil {
+			return err
+		}
+		v.SetString(s)
+	case reflect.Ptr:
+		if !v.IsNil() {
+			return expandConfigEnv(v.Elem())
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if err := expandConfigEnv(v.Field(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := expandConfigEnv(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map: // map的值不能直接设置, 复制后写回
+		for _, key := range v.MapKeys() {
+			value := reflect.New(v.Type().Elem()).Elem()
+			value.Set(v.MapIndex(key))
+			if err := expandConfigEnv(value); err != nil {
+				return err
+			}
+			v.SetMapIndex(key, value)
+		}
+	}
+	return nil
+}
+
+func expandConfigEnvString(s string) (string, error) {
+	var err error
+	s = configEnvRegexp.ReplaceAllStringFunc(s, func(match string) string {
+		sub := configEnvRegexp.FindStringSubmatch(match)
+		if value, ok := os.LookupEnv(sub[1]); ok {
+			return value
+		}
+		if sub[2] != "" { // 使用默认值
+			return sub[3]
+		}
+		if err == nil {
+			err = fmt.Errorf("config env '%s' is not set", sub[1])
+		}
+		return match
+	})
+	return s, err
+}
+
+// InitConfigFile 读取配置文件并初始化其中所有的db, engine和engine group
+func InitConfigFile(path string) error {
+	config, err := LoadConfig(path)
+	if err != nil {
+		return err
+	}
+	return InitConfig(config)
+}
+
+// InitConfig 依次初始化配置中的xorm engine, xorm engine group和gorm db
+func InitConfig(config *Config) error {
+	configState.Lock()
+	defer configState.Unlock()
+	for name, cache := range configState.caches {
+		delete(configState.caches, name)
+		time.AfterFunc(DrainTimeout, func() { _ = cache.Close() })
+	}
+	return applyConfig(nil, config)
+}
+
+// 对比old与config,只初始化新增或变更的条目并关闭已删除的条目,old为nil时初始化全部条目
+// 中途失败时已经替换的条目不会回滚, 记录实际生效的配置供下次对比, 见partialConfig
+func applyConfig(old, config *Config) (err error) {
+	if old == nil {
+		old = &Config{}
+	}
+	redis := make(map[string]RedisCacheConfig, len(config.Redis))
+	changedRedis := make(map[string]bool)
+	for _, r := range config.Redis {
+		if r.Name == "" {
+			return errors.New("redis cache name is empty")
+		}
+		redis[r.Name] = r
+	}
+	changedXOrm := make(map[string]bool)
+	appliedGroups, appliedGOrm := make(map[string]bool), make(map[string]bool)
+	defer func() {
+		if err != nil {
+			configState.config = partialConfig(old, config, changedRedis, changedXOrm, appliedGroups, appliedGOrm)
+		}
+	}()
+	for _, r := range old.Redis {
+		if n, ok := redis[r.Name]; !ok || !reflect.DeepEqual(n, r) {
+			changedRedis[r.Name] = true
+		}
+	}
+	if configState.caches == nil {
+		configState.caches = make(map[string]*xOrmRedisCache)
+	}
+	for name := range changedRedis {
+		if cache, ok := configState.caches[name]; ok { // 等待引用旧cache的engine排空后再关闭
+			delete(configState.caches, name)
+			time.AfterFunc(DrainTimeout, func() { _ = cache.Close() })
+		}
+	}
+
+	oldXOrm := make(map[string]XOrmConfig, len(old.XOrm))
+	for _, c := range old.XOrm {
+		oldXOrm[c.Name] = c
+	}
+	for i := range config.XOrm {
+		c := &config.XOrm[i]
+		if o, ok := oldXOrm[c.Name]; ok && reflect.DeepEqual(o, *c) && !c.usesRedis(changedRedis) {
+			delete(oldXOrm, c.Name)
+			continue
+		}
+		delete(oldXOrm, c.Name)
+		options, err := c.options(redis, configState.caches)
+		if err != nil {
+			return err
+		}
+		if err = InitXOrmEngine(options...); err != nil {
+			return err
+		}
+		changedXOrm[c.Name] = true
+	}
+
+	oldGroups := make(map[string]XOrmGroupConfig, len(old.XOrmGroups))
+	for _, c := range old.XOrmGroups {
+		oldGroups[c.Name] = c
+	}
+	for i := range config.XOrmGroups {
+		c := &config.XOrmGroups[i]
+		if o, ok := oldGroups[c.Name]; ok && reflect.DeepEqual(o, *c) && !c.usesEngine(changedXOrm) {
+			delete(oldGroups, c.Name)
+			continue
+		}
+		delete(oldGroups, c.Name)
+		options, err := c.options()
+		if err != nil {
+			return err
+		}
+		if err = InitXOrmEngineGroup(options...); err != nil {
+			return err
+		}
+		appliedGroups[c.Name] = true
+	}
+
+	oldGOrm := make(map[string]GOrmConfig, len(old.GOrm))
+	for _, c := range old.GOrm {
+		oldGOrm[c.Name] = c
+	}
+	for i := range config.GOrm {
+		c := &config.GOrm[i]
+		if o, ok := oldGOrm[c.Name]; ok && reflect.DeepEqual(o, *c) && !changedRedis[c.RedisCache] {
+			delete(oldGOrm, c.Name)
+			continue
+		}
+		delete(oldGOrm, c.Name)
+		options, err := c.options(redis)
+		if err != nil {
+			return err
+		}
+		if err = InitGOrmDB(options...); err != nil {
+			return err
+		}
+		appliedGOrm[c.Name] = true
+	}
+
+	// 关闭配置中已删除的条目
+	var errs ormErrors
+	for name := range oldGroups {
+		if err := CloseXOrmEngineGroup(name); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for name := range oldXOrm {
+		if err := CloseXOrmEngine(name); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for name := range oldGOrm {
+		if err := CloseGOrmDB(name); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	configState.config = config
+	return errs.err()
+}
+
+// partialConfig 返回applyConfig中途失败时实际生效的配置, 已经重新初始化的条目使用config中的值, 其余保留old中的值
+// 变更的redis保留旧值, 使仍引用旧cache的条目下次被视为变更;
+// 已重新初始化的engine被尚未重新初始化的分组使用时同样保留旧值, 使分组下次随engine重新初始化
+func partialConfig(old, config *Config, changedRedis, appliedXOrm, appliedGroups, appliedGOrm map[string]bool) *Config {
+	partial := &Config{}
+	for _, r := range old.Redis {
+		if changedRedis[r.Name] {
+			partial.Redis = append(partial.Redis, r)
+		}
+	}
+	for _, r := range config.Redis {
+		if !changedRedis[r.Name] {
+			partial.Redis = append(partial.Redis, r)
+		}
+	}
+	pendingEngines := make(map[string]bool)
+	for _, c := range config.XOrmGroups {
+		if !appliedGroups[c.Name] {
+			pendingEngines[c.Master] = true
+			for _, slave := range c.Slaves {
+				pendingEngines[slave.Engine] = true
+			}
+		}
+	}
+	for _, c := range old.XOrm {
+		if !appliedXOrm[c.Name] || pendingEngines[c.Name] {
+			partial.XOrm = append(partial.XOrm, c)
+		}
+	}
+	for _, c := range config.XOrm {
+		if appliedXOrm[c.Name] && !pendingEngines[c.Name] {
+			partial.XOrm = append(partial.XOrm, c)
+		} else if appliedXOrm[c.Name] && !partial.hasXOrm(c.Name) { // 新增的engine没有旧值, 保留一个必然不同的值
+			partial.XOrm = append(partial.XOrm, XOrmConfig{Name: c.Name})
+		}
+	}
+	for _, c := range old.XOrmGroups {
+		if !appliedGroups[c.Name] {
+			partial.XOrmGroups = append(partial.XOrmGroups, c)
+		}
+	}
+	for _, c := range config.XOrmGroups {
+		if appliedGroups[c.Name] {
+			partial.XOrmGroups = append(partial.XOrmGroups, c)
+		}
+	}
+	for _, c := range old.GOrm {
+		if !appliedGOrm[c.Name] {
+			partial.GOrm = append(partial.GOrm, c)
+		}
+	}
+	for _, c := range config.GOrm {
+		if appliedGOrm[c.Name] {
+			partial.GOrm = append(partial.GOrm, c)
+		}
+	}
+	return partial
+}
+
+func (c *Config) hasXOrm(name string) bool {
+	for _, x := range c.XOrm {
+		if x.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *GOrmConfig) options(redis map[string]RedisCacheConfig) ([]GOrmOptions, error) {
+	options := []GOrmOptions{
+		GOrmName(c.Name),
+		GOrmDriver(c.Driver),
+		GOrmDataSource(c.DataSource),
+		GOrmShowSQL(c.ShowSQL),
+		GOrmMaxIdleConn(c.MaxIdleConn),
+		GOrmMaxOpenConn(c.MaxOpenConn),
+		GOrmConnMaxLifetime(time.Duration(c.ConnMaxLifetime)),
+	}
+	if c.RedisCache != "" {
+		r, ok := redis[c.RedisCache]
+		if !ok {
+			return nil, fmt.Errorf("gorm '%s' redis cache '%s' not found", c.Name, c.RedisCache)
+		}
+		options = append(options, GOrmOpenRedisCache(r.Hosts, r.Password, r.DB, time.Duration(r.Expiration), GOrmRedisCacheNamespace(r.Namespace)))
+	}
+	for _, replica := range c.Replicas {
+		options = append(options, GOrmReplica(replica.DataSource, replica.Weight))
+	}
+	switch c.Policy {
+	case "random":
+		options = append(options, GOrmUseRandomPolicy())
+	case "least_conn":
+		options = append(options, GOrmUseLeastConnPolicy())
+	case "round_robin", "":
+		options = append(options, GOrmUseRoundRobinPolicy())
+	default:
+		return nil, fmt.Errorf("gorm '%s' not support policy:%s", c.Name, c.Policy)
+	}
+	return options, nil
+}
+
+func (c *XOrmConfig) options(redis map[string]RedisCacheConfig, caches map[string]*xOrmRedisCache) ([]XOrmOption, error) {
+	options := []XOrmOption{
+		XOrmEngineName(c.Name),
+		XOrmDriver(c.Driver),
+		XOrmDataSource(c.DataSource),
+		XOrmMaxIdleConn(c.MaxIdleConn),
+		XOrmMaxOpenConn(c.MaxOpenConn),
+		XOrmConnMaxLifetime(time.Duration(c.ConnMaxLifetime)),
+		XOrmSchema(c.Schema),
+		XOrmShowSQL(c.ShowSQL),
+		XOrmShowExecTime(c.ShowExecTime),
+		XOrmNoAutoTime(c.NoAutoTime),
+		XOrmBufferSize(c.BufferSize),
+		XOrmCharset(c.Charset),
+		XOrmCascade(c.Cascade),
+		XOrmDisableGlobalCache(c.DisableGlobalCache),
+	}
+	for _, tz := range []struct {
+		name   string
+		option func(*time.Location) XOrmOption
+	}{{c.TZDatabase, XOrmTZDatabase}, {c.TZLocation, XOrmTZLocation}} {
+		if tz.name == "" {
+			continue
+		}
+		location, err := time.LoadLocation(tz.name)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, tz.option(location))
+	}
+	for _, m := range []struct {
+		name   string
+		option func(core.IMapper) XOrmOption
+	}{{c.Mapper, XOrmMapper}, {c.TableMapper, XOrmTableMapper}, {c.ColumnMapper, XOrmColumnMapper}} {
+		if m.name == "" {
+			continue
+		}
+		mapper, err := xOrmConfigMapper(m.name)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, m.option(mapper))
+	}
+	cache := func(name string) (*xOrmRedisCache, error) {
+		if cache, ok := caches[name]; ok {
+			return cache, nil
+		}
+		r, ok := redis[name]
+		if !ok {
+			return nil, fmt.Errorf("xorm '%s' redis cache '%s' not found", c.Name, name)
+		}
+		cacheOptions, err := r.xOrmOptions()
+		if err != nil {
+			return nil, err
+		}
+		cache, err := NewXOrmRedisCache(r.Hosts, r.Password, r.DB, time.Duration(r.Expiration), cacheOptions...)
+		if err != nil {
+			return nil, fmt.Errorf("xorm '%s' redis cache '%s' error: %v", c.Name, name, err)
+		}
+		caches[name] = cache
+		return cache, nil
+	}
+	if c.DefaultCache != "" {
+		defaultCache, err := cache(c.DefaultCache)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, XOrmDefaultCache(defaultCache))
+	}
+	for table, name := range c.Caches {
+		tableCache, err := cache(name)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, XOrmCache(table, tableCache))
+	}
+	return options, nil
+}
+
+func (c *XOrmConfig) usesRedis(names map[string]bool) bool {
+	if names[c.DefaultCache] {
+		return true
+	}
+	for _, name := range c.Caches {
+		if names[name] {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *XOrmGroupConfig) usesEngine(names map[string]bool) bool {
+	if names[c.Master] {
+		return true
+	}
+	for _, slave := range c.Slaves {
+		if names[slave.Engine] {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *XOrmGroupConfig) options() ([]XOrmGroupOption, error) {
+	options := []XOrmGroupOption{XOrmGroupName(c.Name), XOrmMaster(XOrmEngine(c.Master))}
+	for _, slave := range c.Slaves {
+		options = append(options, XOrmSlaveZone(XOrmEngine(slave.Engine), slave.Weight, slave.Zone))
+	}
+	switch c.Policy {
+	case "random":
+		options = append(options, XOrmUseRandomPolicy())
+	case "least_conn":
+		options = append(options, XOrmUseLeastConnPolicy())
+	case "round_robin", "":
+		options = append(options, XOrmUseRoundRobinPolicy())
+	case "latency":
+		options = append(options, XOrmUsePolicy(XOrmLatencyPolicy(0)))
+	case "zone_affinity":
+		options = append(options, XOrmUsePolicy(XOrmZoneAffinityPolicy(c.Zone)))
+	case "consistent_hash":
+		options = append(options, XOrmUsePolicy(XOrmConsistentHashPolicy(0)))
+	default:
+		return nil, fmt.Errorf("xorm engine group '%s' not support policy:%s", c.Name, c.Policy)
+	}
+	if c.ProbeInterval > 0 {
+		options = append(options, XOrmGroupProbeInterval(time.Duration(c.ProbeInterval)))
+	}
+	if c.MaxReplicationLag > 0 {
+		options = append(options, XOrmGroupMaxReplicationLag(time.Duration(c.MaxReplicationLag)))
+	}
+	if c.LagHeartbeat != "" {
+		options = append(options, XOrmGroupLagHeartbeat(c.LagHeartbeat))
+	}
+	if c.StickyWindow > 0 {
+		options = append(options, XOrmGroupStickyWindow(time.Duration(c.StickyWindow)))
+	}
+	return options, nil
+}
+
+func (c *RedisCacheConfig) xOrmOptions() ([]XOrmRedisCacheOption, error) {
+	options := []XOrmRedisCacheOption{
+		XOrmRedisCacheVersion(c.Version),
+		XOrmRedisCacheVerify(c.Verify),
+		XOrmRedisCacheSingleflight(time.Duration(c.Singleflight)),
+		XOrmRedisCacheLock(time.Duration(c.Lock)),
+		XOrmRedisCacheXFetch(c.XFetch),
+		XOrmRedisCacheNegative(time.Duration(c.Negative)),
+		XOrmRedisCacheIdsTTL(time.Duration(c.IdsExpiration)),
+		XOrmRedisCacheJitter(c.Jitter),
+		XOrmRedisCacheTimeout(time.Duration(c.Timeout)),
+		XOrmRedisCacheBreaker(c.BreakerFailures, time.Duration(c.BreakerCooldown)),
+		XOrmRedisCacheGenerations(c.Generations),
+		XOrmRedisCacheNamespace(c.Namespace),
+	}
+	for table, ttl := range c.Tables {
+		options = append(options, XOrmRedisCacheTableTTL(table, time.Duration(ttl.Expiration), time.Duration(ttl.IdsExpiration)))
+	}
+	switch c.Codec {
+	case "", "gob":
+	case "json":
+		options = append(options, XOrmRedisCacheCodec(XOrmCacheJSONCodec))
+	case "msgpack":
+		options = append(options, XOrmRedisCacheCodec(XOrmCacheMsgpackCodec))
+	default:
+		return nil, fmt.Errorf("redis cache '%s' not support codec:%s", c.Name, c.Codec)
+	}
+	switch c.Compression {
+	case "", "none":
+	case "snappy":
+		options = append(options, XOrmRedisCacheCompression(XOrmCacheSnappy, c.CompressThreshold))
+	case "zstd":
+		options = append(options, XOrmRedisCacheCompression(XOrmCacheZstd, c.CompressThreshold))
+	case "gzip":
+		options = append(options, XOrmRedisCacheCompression(XOrmCacheGzip, c.CompressThreshold))
+	default:
+		return nil, fmt.Errorf("redis cache '%s' not support compression:%s", c.Name, c.Compression)
+	}
+	return options, nil
+}
+
+func xOrmConfigMapper(name string) (core.IMapper, error) {
+	switch name {
+	case "same":
+		return XOrmSameMapper, nil
+	case "snake":
+		return XOrmSnakeMapper, nil
+	case "gonic":
+		return core.LintGonicMapper, nil
+	default:
+		return nil, fmt.Errorf("not support xorm mapper:%s", name)
+	}
+}
@@ -0,0 +1,79 @@
+package orm
+
+import (
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+var configWatchers sync.Map // make(map[*configWatcher]struct{})
+
+type configWatcher struct {
+	path     string
+	interval time.Duration
+	done     chan struct{}
+	once     sync.Once
+}
+
+// ReloadConfig 与当前生效的配置对比,重新初始化变更的条目并关闭已删除的条目
+// 新的连接池会立即替换注册表中的旧连接池,GOrmDB/XOrmEngine/XOrmEngineGroup随后返回新的句柄,
+// 旧连接池在正在执行的查询结束后(最长等待DrainTimeout)关闭
+func ReloadConfig(config *Config) error {
+	configState.Lock()
+	defer configState.Unlock()
+	return applyConfig(configState.config, config)
+}
+
+// ReloadConfigFile 读取配置文件并热更新
+func ReloadConfigFile(path string) error {
+	config, err := LoadConfig(path)
+	if err != nil {
+		return err
+	}
+	return ReloadConfig(config)
+}
+
+// WatchConfigFile 每隔interval检查配置文件的修改时间,文件变更后自动热更新,返回停止监听的函数
+func WatchConfigFile(path string, interval time.Duration) (stop func()) {
+	w := &configWatcher{path: path, interval: interval, done: make(chan struct{})}
+	configWatchers.Store(w, struct{}{})
+	go w.run()
+	return w.stop
+}
+
+func (w *configWatcher) stop() {
+	w.once.Do(func() {
+		close(w.done)
+		configWatchers.Delete(w)
+	})
+}
+
+func (w *configWatcher) run() {
+	var modTime time.Time
+	var size int64
+	if info, err := os.Stat(w.path); err == nil {
+		modTime, size = info.ModTime(), info.Size()
+	}
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			info, err := os.Stat(w.path)
+			if err != nil {
+				log.Printf("[ERROR] orm watch config file '%s' error: %v", w.path, err)
+				continue
+			}
+			if info.ModTime().Equal(modTime) && info.Size() == size {
+				continue
+			}
+			modTime, size = info.ModTime(), info.Size()
+			if err = ReloadConfigFile(w.path); err != nil {
+				log.Printf("[ERROR] orm reload config file '%s' error: %v", w.path, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package orm
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+var configTestData = map[string]string{
+	ConfigYAML: `
+redis:
+  - name: cache
+    hosts: ["127.0.0.1:6379"]
+    password: ${ORM_TEST_REDIS_PASSWORD}
+    expiration: 60s
+xorm:
+  - name: master
+    driver: mysql
+    data_source: root:${ORM_TEST_DB_PASSWORD}@tcp(127.0.0.1:3306)/test
+    conn_max_lifetime: 1m
+    mapper: snake
+    default_cache: cache
+xorm_groups:
+  - name: default
+    master: master
+    slaves:
+      - engine: slave1
+        weight: 2
+    policy: random
+`,
+	ConfigJSON: `{
+	"redis": [{"name": "cache", "hosts": ["127.0.0.1:6379"], "password": "${ORM_TEST_REDIS_PASSWORD}", "expiration": "60s"}],
+	"xorm": [{"name": "master", "driver": "mysql", "data_source": "root:${ORM_TEST_DB_PASSWORD}@tcp(127.0.0.1:3306)/test", "conn_max_lifetime": "1m", "mapper": "snake", "default_cache": "cache"}],
+	"xorm_groups": [{"name": "default", "master": "master", "slaves": [{"engine": "slave1", "weight": 2}], "policy": "random"}]
+}`,
+	ConfigTOML: `
+[[redis]]
+name = "cache"
+hosts = ["127.0.0.1:6379"]
+password = "${ORM_TEST_REDIS_PASSWORD}"
+expiration = "60s"
+
+[[xorm]]
+name = "master"
+driver = "mysql"
+data_source = "root:${ORM_TEST_DB_PASSWORD}@tcp(127.0.0.1:3306)/test"
+conn_max_lifetime = "1m"
+mapper = "snake"
+default_cache = "cache"
+
+[[xorm_groups]]
+name = "default"
+master = "master"
+policy = "random"
+[[xorm_groups.slaves]]
+engine = "slave1"
+weight = 2
+`,
+}
+
+func TestParseConfig(t *testing.T) {
+	os.Setenv("ORM_TEST_DB_PASSWORD", "secret")
+	os.Setenv("ORM_TEST_REDIS_PASSWORD", "redis")
+	defer os.Unsetenv("ORM_TEST_DB_PASSWORD")
+	defer os.Unsetenv("ORM_TEST_REDIS_PASSWORD")
+	for format, data := range configTestData {
+		config, err := ParseConfig([]byte(data), format)
+		if err != nil {
+			t.Error(format, err)
+			t.FailNow()
+		}
+		if len(config.Redis) != 1 || config.Redis[0].Password != "redis" || time.Duration(config.Redis[0].Expiration) != time.Minute {
+			t.Errorf("%s redis config error: %+v", format, config.Redis)
+		}
+		if len(config.XOrm) != 1 || config.XOrm[0].DataSource != "root:secret@tcp(127.0.0.1:3306)/test" ||
+			time.Duration(config.XOrm[0].ConnMaxLifetime) != time.Minute || config.XOrm[0].DefaultCache != "cache" {
+			t.Errorf("%s xorm config error: %+v", format, config.XOrm)
+		}
+		if len(config.XOrmGroups) != 1 || len(config.XOrmGroups[0].Slaves) != 1 ||
+			config.XOrmGroups[0].Slaves[0].Weight != 2 || config.XOrmGroups[0].Policy != "random" {
+			t.Errorf("%s xorm group config error: %+v", format, config.XOrmGroups)
+		}
+	}
+}
+
+func TestParseConfigEnv(t *testing.T) {
+	os.Unsetenv("ORM_TEST_UNSET")
+	if _, err := ParseConfig([]byte(`{"xorm": [{"data_source": "${ORM_TEST_UNSET}"}]}`), ConfigJSON); err == nil {
+		t.Error("unset env should return error")
+	}
+	config, err := ParseConfig([]byte(`{"xorm": [{"data_source": "${ORM_TEST_UNSET:-default}"}]}`), ConfigJSON)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if config.XOrm[0].DataSource != "default" {
+		t.Errorf("env default value error: %s", config.XOrm[0].DataSource)
+	}
+}
+
+func TestParseConfigEnvValue(t *testing.T) {
+	value := "p\"a:s#s\nword"
+	os.Setenv("ORM_TEST_DB_PASSWORD", value)
+	os.Setenv("ORM_TEST_REDIS_PASSWORD", value)
+	defer os.Unsetenv("ORM_TEST_DB_PASSWORD")
+	defer os.Unsetenv("ORM_TEST_REDIS_PASSWORD")
+	for format, data := range configTestData {
+		config, err := ParseConfig([]byte(data), format)
+		if err != nil {
+			t.Error(format, err)
+			t.FailNow()
+		}
+		if len(config.Redis) != 1 || config.Redis[0].Password != value ||
+			len(config.XOrm) != 1 || config.XOrm[0].DataSource != "root:"+value+"@tcp(127.0.0.1:3306)/test" {
+			t.Errorf("%s env value should not be parsed: %+v", format, config.XOrm)
+		}
+	}
+	config, err := ParseConfig([]byte(`{"xorm": [{"name": "a", "caches": {"t": "${ORM_TEST_DB_PASSWORD}"}}]}`), ConfigJSON)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if config.XOrm[0].Caches["t"] != value {
+		t.Errorf("env in map value error: %+v", config.XOrm[0].Caches)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	drainTimeout := DrainTimeout
+	DrainTimeout = time.Millisecond * 200
+	defer func() { DrainTimeout = drainTimeout }()
+
+	config := &Config{XOrm: []XOrmConfig{
+		{Name: "reload_a", Driver: "mysql", DataSource: "root:root@tcp(127.0.0.1:3306)/a"},
+		{Name: "reload_b", Driver: "mysql", DataSource: "root:root@tcp(127.0.0.1:3306)/b"},
+		{Name: "reload_c", Driver: "mysql", DataSource: "root:root@tcp(127.0.0.1:3306)/c"},
+	}, XOrmGroups: []XOrmGroupConfig{
+		{Name: "reload_group", Master: "reload_a", Slaves: []XOrmSlaveConfig{{Engine: "reload_b"}}},
+	}}
+	if err := InitConfig(config); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	a, b, group := XOrmEngine("reload_a"), XOrmEngine("reload_b"), XOrmEngineGroup("reload_group")
+
+	reload := &Config{XOrm: []XOrmConfig{
+		{Name: "reload_a", Driver: "mysql", DataSource: "root:rotated@tcp(127.0.0.1:3306)/a"},
+		{Name: "reload_b", Driver: "mysql", DataSource: "root:root@tcp(127.0.0.1:3306)/b"},
+	}, XOrmGroups: config.XOrmGroups}
+	if err := ReloadConfig(reload); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if XOrmEngine("reload_a") == a {
+		t.Error("changed engine was not replaced")
+	}
+	if XOrmEngine("reload_b") != b {
+		t.Error("unchanged engine was replaced")
+	}
+	if XOrmEngine("reload_c") != nil {
+		t.Error("removed engine is still registered")
+	}
+	if g := XOrmEngineGroup("reload_group"); g == group || g.Master() != XOrmEngine("reload_a") {
+		t.Error("engine group was not rebuilt with the new master")
+	}
+	time.Sleep(DrainTimeout * 2)
+	if err := a.DB().Ping(); err == nil || err.Error() != "sql: database is closed" {
+		t.Errorf("replaced engine should be closed after drain, got: %v", err)
+	}
+	if err := CloseAll(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReloadConfigPartial(t *testing.T) {
+	config := &Config{XOrm: []XOrmConfig{
+		{Name: "partial_a", Driver: "mysql", DataSource: "root:root@tcp(127.0.0.1:3306)/a"},
+	}}
+	if err := InitConfig(config); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	// 分组的策略错误, engine已经替换或新增后失败
+	reload := &Config{XOrm: []XOrmConfig{
+		{Name: "partial_a", Driver: "mysql", DataSource: "root:rotated@tcp(127.0.0.1:3306)/a"},
+		{Name: "partial_b", Driver: "mysql", DataSource: "root:root@tcp(127.0.0.1:3306)/b"},
+	}, XOrmGroups: []XOrmGroupConfig{
+		{Name: "partial_group", Master: "partial_a", Slaves: []XOrmSlaveConfig{{Engine: "partial_b"}}, Policy: "unknown"},
+	}}
+	if err := ReloadConfig(reload); err == nil {
+		t.Error("reload with unknown policy should return error")
+		t.FailNow()
+	}
+	if XOrmEngine("partial_b") == nil {
+		t.Error("engine applied before the error should stay registered")
+	}
+	if err := ReloadConfig(&Config{XOrm: reload.XOrm[:1]}); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if XOrmEngine("partial_b") != nil {
+		t.Error("engine added by the failed reload was not closed")
+	}
+	if err := ReloadConfig(&Config{}); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if XOrmEngine("partial_a") != nil {
+		t.Error("removed engine is still registered")
+	}
+}
@@ -4,9 +4,17 @@ go 1.14
 
 require (
 	github.com/8treenet/gcache v1.1.4
+	github.com/BurntSushi/toml v0.3.1
+	github.com/alicebob/miniredis/v2 v2.30.0
 	github.com/go-redis/redis v6.15.7+incompatible
 	github.com/go-sql-driver/mysql v1.5.0
 	github.com/go-xorm/xorm v0.7.9
+	github.com/golang/snappy v0.0.1
 	github.com/jinzhu/gorm v1.9.12
+	github.com/klauspost/compress v1.10.3
+	github.com/mattn/go-sqlite3 v2.0.1+incompatible
+	github.com/prometheus/client_golang v1.5.1
+	github.com/vmihailenco/msgpack v4.0.4+incompatible
+	gopkg.in/yaml.v2 v2.2.5
 	xorm.io/core v0.7.2-0.20190928055935-90aeac8d08eb
 )
@@ -1,6 +1,7 @@
 package orm
 
 import (
+	"database/sql"
 	"errors"
 	"github.com/jinzhu/gorm"
 	"io"
@@ -12,7 +13,11 @@ import (
 var gOrmDB sync.Map
 
 type gOrm struct {
+	driver     string
+	dataSource string // 绑定事务时打开单独的连接
 	db         *gorm.DB
+	master     *sql.DB
+	replicas   []*sql.DB
 	redisCache GOrmRedisCache
 	logger     *gOrmLogger
 }
@@ -29,6 +34,9 @@ type gOrmOptions struct {
 	autoMigrate      []interface{}
 	redisCache       *gOrmRedisCache
 	redisCachePlugin GOrmRedisCache
+	replicas         []gOrmReplica
+	policy           int
+	isWeight         bool
 }
 
 type GOrmOptions func(*gOrmOptions)
@@ -96,20 +104,23 @@ func GOrmAutoMigrate(autoMigrate ...interface{}) GOrmOptions {
 	}
 }
 
-func GOrmOpenRedisCache(hosts []string, password string, db int, expiration time.Duration) GOrmOptions {
+func GOrmOpenRedisCache(hosts []string, password string, db int, expiration time.Duration, cacheOptions ...GOrmRedisCacheOption) GOrmOptions {
 	return func(options *gOrmOptions) {
-		options.redisCache = NewGOrmRedisCache(hosts, password, db, expiration)
+		options.redisCache = NewGOrmRedisCache(hosts, password, db, expiration, cacheOptions...)
 	}
 }
 
 func initGOrmOptions(options ...GOrmOptions) (*gOrmOptions, error) {
-	opts := &gOrmOptions{}
+	opts := &gOrmOptions{policy: gOrmRoundRobinPolicy}
 	for _, opt := range options {
 		opt(opts)
 	}
 	if opts.name == "" {
 		return nil, errors.New("gorm name is empty")
 	}
+	if opts.policy == gOrmLeastConnPolicy && opts.isWeight {
+		return nil, errors.New("gorm least conn policy does not support replica weight")
+	}
 	return opts, nil
 }
 
@@ -122,25 +133,26 @@ func InitGOrmDB(options ...GOrmOptions) error {
 	if err != nil {
 		return err
 	}
-	if opts.logger != nil {
-		db.SetLogger(opts.logger)
-	}
-	if opts.maxOpenConn > 0 {
-		db.DB().SetMaxOpenConns(opts.maxOpenConn)
-	}
-	if opts.maxIdleConn > 0 {
-		db.DB().SetMaxIdleConns(opts.maxIdleConn)
-	}
-	if opts.connMaxLifetime > 0 {
-		db.DB().SetConnMaxLifetime(opts.connMaxLifetime)
+	master := db.DB()
+	gOrmSetPool(master, opts)
+	if err = gOrmSetLogger(db, opts); err != nil {
+		return err
 	}
-	if opts.showSQL {
-		if err = db.LogMode(opts.showSQL).Error; err != nil {
+	if len(opts.autoMigrate) > 0 { // 迁移始终在master上执行
+		if err = db.AutoMigrate(opts.autoMigrate...).Error; err != nil {
 			return err
 		}
 	}
-	if len(opts.autoMigrate) > 0 {
-		if err = db.AutoMigrate(opts.autoMigrate...).Error; err != nil {
+	var replicas []*sql.DB
+	if len(opts.replicas) > 0 {
+		if replicas, err = gOrmOpenReplicas(opts); err != nil {
+			return err
+		}
+		router := &gOrmReplicaDB{master: master, replicas: replicas, policy: opts.replicaPolicy()}
+		if db, err = gorm.Open(opts.driver, router); err != nil {
+			return err
+		}
+		if err = gOrmSetLogger(db, opts); err != nil {
 			return err
 		}
 	}
@@ -150,15 +162,80 @@ func InitGOrmDB(options ...GOrmOptions) error {
 			opts.redisCachePlugin.Debug()
 		}
 	}
-	gOrmRegister(opts.name, db, opts.redisCachePlugin)
+	gOrmRegister(opts.name, &gOrm{
+		driver:     opts.driver,
+		dataSource: opts.dataSource,
+		db:         db,
+		master:     master,
+		replicas:   replicas,
+		redisCache: opts.redisCachePlugin,
+		logger:     opts.logger,
+	})
 	return nil
 }
 
-func gOrmRegister(name string, db *gorm.DB, plugin GOrmRedisCache) {
-	gOrmDB.Store(name, &gOrm{db: db, redisCache: plugin})
+func gOrmSetPool(db *sql.DB, opts *gOrmOptions) {
+	if opts.maxOpenConn > 0 {
+		db.SetMaxOpenConns(opts.maxOpenConn)
+	}
+	if opts.maxIdleConn > 0 {
+		db.SetMaxIdleConns(opts.maxIdleConn)
+	}
+	if opts.connMaxLifetime > 0 {
+		db.SetConnMaxLifetime(opts.connMaxLifetime)
+	}
+}
+
+func gOrmSetLogger(db *gorm.DB, opts *gOrmOptions) error {
+	if opts.logger != nil {
+		db.SetLogger(opts.logger)
+	}
+	if opts.showSQL {
+		return db.LogMode(opts.showSQL).Error
+	}
+	return nil
+}
+
+func gOrmRegister(name string, o *gOrm) {
+	old, loaded := gOrmDB.Load(name)
+	gOrmDB.Store(name, o)
+	if loaded && old != nil && old != o { // 重复初始化时排空并释放旧的连接池
+		old := old.(*gOrm)
+		drainClose("gorm db '"+name+"'", old.close, append([]*sql.DB{old.master}, old.replicas...)...)
+	}
+}
+
+func (o *gOrm) close() error {
+	var errs ormErrors
+	if err := o.db.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	for _, replica := range o.replicas {
+		if err := replica.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if client := gOrmRedisCacheClient(o.redisCache); client != nil {
+		if err := client.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs.err()
+}
+
+// CloseGOrmDB 关闭并注销指定名称的gorm db
+func CloseGOrmDB(name string) error {
+	if i, ok := gOrmDB.Load(name); ok && i != nil {
+		gOrmDB.Delete(name)
+		return i.(*gOrm).close()
+	}
+	return nil
 }
 
 func GOrmDB(name string) *gorm.DB {
+	if tx, ok := gOrmTxs.Load(name); ok {
+		return tx.(*gorm.DB)
+	}
 	if i, ok := gOrmDB.Load(name); ok && i != nil {
 		return i.(*gOrm).db
 	}
@@ -3,24 +3,49 @@ package orm
 import (
 	"github.com/8treenet/gcache"
 	"github.com/8treenet/gcache/option"
+	"github.com/go-redis/redis"
 	"github.com/jinzhu/gorm"
+	"reflect"
 	"strings"
 	"time"
+	"unsafe"
 )
 
 type GOrmRedisCache interface {
 	gcache.Plugin
 }
 
+type GOrmRedisCacheOption func(cache *gOrmRedisCache)
+
 type gOrmRedisCache struct {
-	hosts    []string
-	password string
-	db       int
-	options  *gcache.DefaultOption
+	hosts     []string
+	password  string
+	db        int
+	options   *gcache.DefaultOption
+	namespace string
+	tenant    string
+}
+
+// 所有key前加上 namespace + ":", 用于多个服务或环境共用同一个redis库, FlushDB只清除namespace下的key
+func GOrmRedisCacheNamespace(namespace string) GOrmRedisCacheOption {
+	return func(cache *gOrmRedisCache) {
+		cache.namespace = namespace
+	}
 }
 
-func NewGOrmRedisCache(hosts []string, password string, db int, expiration time.Duration) *gOrmRedisCache {
+// key前缀为 namespace@tenant: , 用于多个租户共用同一个redis库
+// gorm没有ctx, 无法按请求区分租户, 每个租户需要注册各自的*gorm.DB
+func GOrmRedisCacheTenant(tenant string) GOrmRedisCacheOption {
+	return func(cache *gOrmRedisCache) {
+		cache.tenant = tenant
+	}
+}
+
+func NewGOrmRedisCache(hosts []string, password string, db int, expiration time.Duration, options ...GOrmRedisCacheOption) *gOrmRedisCache {
 	cache := &gOrmRedisCache{hosts: hosts, password: password, db: db}
+	for _, option := range options {
+		option(cache)
+	}
 	cache.options = &option.DefaultOption{Opt: option.Opt{
 		Expires:         int(expiration / time.Second), // 缓存时间，默认120秒。范围 30-3600
 		Level:           option.LevelSearch,            // 缓存级别，默认LevelSearch。LevelDisable:关闭缓存，LevelModel:模型缓存， LevelSearch:查询缓存
@@ -31,9 +56,73 @@ func NewGOrmRedisCache(hosts []string, password string, db int, expiration time.
 }
 
 func (c *gOrmRedisCache) SetCacheDB(db *gorm.DB) GOrmRedisCache {
-	return gcache.AttachDB(db, c.options, &option.RedisOption{
+	plugin := gcache.AttachDB(db, c.options, &option.RedisOption{
 		Addr:     strings.Join(c.hosts, ","),
 		Password: c.password,
 		DB:       c.db,
 	})
+	namespace := c.namespace
+	if c.tenant != "" {
+		namespace += xOrmCacheTenantSep + c.tenant
+	}
+	if namespace != "" {
+		if client := gOrmRedisCacheClient(plugin); client != nil {
+			client.WrapProcess(gOrmRedisCacheNamespaceProcess(client, namespace+":"))
+		}
+	}
+	return plugin
+}
+
+// gcache没有key前缀的配置, 这里在发送命令前给key加上前缀
+func gOrmRedisCacheNamespaceProcess(client *redis.Client, prefix string) func(old func(cmd redis.Cmder) error) func(cmd redis.Cmder) error {
+	return func(old func(cmd redis.Cmder) error) func(cmd redis.Cmder) error {
+		return func(cmd redis.Cmder) error {
+			args := cmd.Args()
+			switch strings.ToLower(cmd.Name()) {
+			case "flushdb", "flushall": // 只清除namespace下的key
+				return xOrmCacheScanUnlink(client, prefix+"*")
+			case "ping", "echo", "select", "auth", "info", "client", "script", "scan", "quit":
+			case "del", "unlink", "exists", "touch", "mget":
+				gOrmRedisCachePrefixArgs(args, prefix, 1, len(args))
+			case "eval", "evalsha":
+				if len(args) > 2 {
+					if n, ok := args[2].(int); ok && 3+n <= len(args) {
+						gOrmRedisCachePrefixArgs(args, prefix, 3, 3+n)
+					}
+				}
+			default:
+				gOrmRedisCachePrefixArgs(args, prefix, 1, 2)
+			}
+			return old(cmd)
+		}
+	}
+}
+
+func gOrmRedisCachePrefixArgs(args []interface{}, prefix string, from, to int) {
+	for i := from; i < to && i < len(args); i++ {
+		if key, ok := args[i].(string); ok {
+			args[i] = prefix + key
+		}
+	}
+}
+
+// gcache没有暴露其内部的redis连接,这里通过反射取出plugin.handle.redisClient用于关闭
+func gOrmRedisCacheClient(plugin GOrmRedisCache) *redis.Client {
+	if plugin == nil {
+		return nil
+	}
+	v := reflect.ValueOf(plugin)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return nil
+	}
+	handle := v.Elem().FieldByName("handle")
+	if !handle.IsValid() || handle.Kind() != reflect.Ptr || handle.IsNil() {
+		return nil
+	}
+	field := handle.Elem().FieldByName("redisClient")
+	if !field.IsValid() {
+		return nil
+	}
+	client, _ := reflect.NewAt(field.Type(), unsafe.Pointer(field.UnsafeAddr())).Elem().Interface().(*redis.Client)
+	return client
 }
@@ -0,0 +1,260 @@
+package orm
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	gOrmRandomPolicy = iota
+	gOrmLeastConnPolicy
+	gOrmRoundRobinPolicy
+)
+
+const (
+	gOrmQueryOptionKey = "gorm:query_option"
+	gOrmUseMasterHint  = "/* orm:use_master */"
+)
+
+// 从replicas中选择一个执行读请求
+type gOrmReplicaPolicy func(replicas []*sql.DB) *sql.DB
+
+type gOrmReplica struct {
+	dataSource string
+	weight     int
+}
+
+func GOrmMaster(dataSource string) GOrmOptions {
+	return GOrmDataSource(dataSource)
+}
+
+// 如果设置权重值,则自动切换为加权策略, LeastConn策略不支持权重
+// 如果没有设置策略,则默认使用RoundRobin
+// 设置从库后*gorm.DB的DB()不可用, 使用GOrmMasterDB以及GOrmReplicas获取连接池
+func GOrmReplica(dataSource string, weight int) GOrmOptions {
+	return func(options *gOrmOptions) {
+		options.replicas = append(options.replicas, gOrmReplica{dataSource: dataSource, weight: weight})
+		if weight > 0 {
+			options.isWeight = true
+		}
+	}
+}
+
+func GOrmUseRandomPolicy() GOrmOptions {
+	return func(options *gOrmOptions) {
+		options.policy = gOrmRandomPolicy
+	}
+}
+
+func GOrmUseLeastConnPolicy() GOrmOptions {
+	return func(options *gOrmOptions) {
+		options.policy = gOrmLeastConnPolicy
+	}
+}
+
+func GOrmUseRoundRobinPolicy() GOrmOptions {
+	return func(options *gOrmOptions) {
+		options.policy = gOrmRoundRobinPolicy
+	}
+}
+
+// GOrmUseMaster 强制之后的查询使用master
+// 通过gorm:query_option在查询语句末尾追加注释, 之后再设置gorm:query_option时需要保留原有的值
+func GOrmUseMaster(db *gorm.DB) *gorm.DB {
+	option := gOrmUseMasterHint
+	if old, ok := db.Get(gOrmQueryOptionKey); ok {
+		if strings.Contains(fmt.Sprint(old), gOrmUseMasterHint) {
+			return db
+		}
+		option = fmt.Sprint(old) + " " + gOrmUseMasterHint
+	}
+	return db.Set(gOrmQueryOptionKey, option)
+}
+
+// GOrmMasterDB 返回指定名称的gorm db的主库
+func GOrmMasterDB(name string) *sql.DB {
+	if i, ok := gOrmDB.Load(name); ok && i != nil {
+		return i.(*gOrm).master
+	}
+	return nil
+}
+
+// GOrmReplicas 返回指定名称的gorm db的所有从库
+func GOrmReplicas(name string) []*sql.DB {
+	if i, ok := gOrmDB.Load(name); ok && i != nil {
+		return i.(*gOrm).replicas
+	}
+	return nil
+}
+
+func (opts *gOrmOptions) replicaPolicy() gOrmReplicaPolicy {
+	weight := make([]int, len(opts.replicas))
+	for i, replica := range opts.replicas {
+		weight[i] = replica.weight
+	}
+	switch opts.policy {
+	case gOrmRandomPolicy:
+		if opts.isWeight {
+			return gOrmWeightRandomPolicy(weight)
+		}
+		return gOrmRandomReplicaPolicy()
+	case gOrmLeastConnPolicy:
+		return gOrmLeastConnReplicaPolicy()
+	default:
+		if opts.isWeight {
+			return gOrmWeightRoundRobinPolicy(weight)
+		}
+		return gOrmRoundRobinReplicaPolicy()
+	}
+}
+
+func gOrmRandomReplicaPolicy() gOrmReplicaPolicy {
+	var r = rand.New(rand.NewSource(time.Now().UnixNano()))
+	var lock sync.Mutex
+	return func(replicas []*sql.DB) *sql.DB {
+		lock.Lock()
+		defer lock.Unlock()
+		return replicas[r.Intn(len(replicas))]
+	}
+}
+
+func gOrmWeightRandomPolicy(weight []int) gOrmReplicaPolicy {
+	var rands = gOrmWeightIndexes(weight)
+	var r = rand.New(rand.NewSource(time.Now().UnixNano()))
+	var lock sync.Mutex
+	return func(replicas []*sql.DB) *sql.DB {
+		lock.Lock()
+		defer lock.Unlock()
+		return replicas[rands[r.Intn(len(rands))]]
+	}
+}
+
+func gOrmRoundRobinReplicaPolicy() gOrmReplicaPolicy {
+	var pos = -1
+	var lock sync.Mutex
+	return func(replicas []*sql.DB) *sql.DB {
+		lock.Lock()
+		defer lock.Unlock()
+		pos++
+		if pos >= len(replicas) {
+			pos = 0
+		}
+		return replicas[pos]
+	}
+}
+
+func gOrmWeightRoundRobinPolicy(weight []int) gOrmReplicaPolicy {
+	var rands = gOrmWeightIndexes(weight)
+	var pos = -1
+	var lock sync.Mutex
+	return func(replicas []*sql.DB) *sql.DB {
+		lock.Lock()
+		defer lock.Unlock()
+		pos++
+		if pos >= len(rands) {
+			pos = 0
+		}
+		return replicas[rands[pos]]
+	}
+}
+
+// 选择正在使用连接数最少的从库
+func gOrmLeastConnReplicaPolicy() gOrmReplicaPolicy {
+	return func(replicas []*sql.DB) *sql.DB {
+		idx, inUse := 0, -1
+		for i, replica := range replicas {
+			if n := replica.Stats().InUse; inUse < 0 || n < inUse {
+				idx, inUse = i, n
+			}
+		}
+		return replicas[idx]
+	}
+}
+
+// 按权重展开下标,权重为0的从库至少占一个位置
+func gOrmWeightIndexes(weight []int) []int {
+	var rands = make([]int, 0, len(weight))
+	for i := 0; i < len(weight); i++ {
+		n := weight[i]
+		if n <= 0 {
+			n = 1
+		}
+		for ; n > 0; n-- {
+			rands = append(rands, i)
+		}
+	}
+	return rands
+}
+
+// 打开所有从库
+func gOrmOpenReplicas(opts *gOrmOptions) ([]*sql.DB, error) {
+	replicas := make([]*sql.DB, 0, len(opts.replicas))
+	for _, replica := range opts.replicas {
+		r, err := sql.Open(opts.driver, replica.dataSource)
+		if err == nil {
+			err = r.Ping()
+		}
+		if err != nil {
+			for _, opened := range replicas {
+				_ = opened.Close()
+			}
+			if r != nil {
+				_ = r.Close()
+			}
+			return nil, err
+		}
+		gOrmSetPool(r, opts)
+		replicas = append(replicas, r)
+	}
+	return replicas, nil
+}
+
+// gOrmReplicaDB 读写分离的gorm.SQLCommon, 只读语句使用从库, 写语句,Prepare以及事务使用master
+type gOrmReplicaDB struct {
+	master   *sql.DB
+	replicas []*sql.DB
+	policy   gOrmReplicaPolicy
+}
+
+func (r *gOrmReplicaDB) query(query string) *sql.DB {
+	if !ormIsReadSQL(query) || strings.Contains(query, gOrmUseMasterHint) {
+		return r.master
+	}
+	return r.policy(r.replicas)
+}
+
+func (r *gOrmReplicaDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return r.master.Exec(query, args...)
+}
+
+func (r *gOrmReplicaDB) Prepare(query string) (*sql.Stmt, error) {
+	return r.master.Prepare(query)
+}
+
+func (r *gOrmReplicaDB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return r.query(query).Query(query, args...)
+}
+
+func (r *gOrmReplicaDB) QueryRow(query string, args ...interface{}) *sql.Row {
+	return r.query(query).QueryRow(query, args...)
+}
+
+func (r *gOrmReplicaDB) Begin() (*sql.Tx, error) {
+	return r.master.Begin()
+}
+
+func (r *gOrmReplicaDB) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	return r.master.BeginTx(ctx, opts)
+}
+
+// 从库由gOrm.close关闭
+func (r *gOrmReplicaDB) Close() error {
+	return r.master.Close()
+}
@@ -1,8 +1,13 @@
 package orm
 
 import (
+	"database/sql"
 	"github.com/jinzhu/gorm"
+	"github.com/marcosxz/orm/internal/redistest"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -16,17 +21,18 @@ type gOrmTestBean struct {
 }
 
 func TestInitGOrmDB(t *testing.T) {
+	s, _ := redistest.New(t)
 	if err := InitGOrmDB(
 		GOrmName("default"),
-		GOrmDriver("mysql"),
-		GOrmDataSource("root:root@tcp(127.0.0.1:3306)/test?charset=utf8"),
+		GOrmDriver("sqlite3"),
+		GOrmDataSource(ormTestSQLite(t, "default")),
 		GOrmMaxIdleConn(10),
 		GOrmMaxOpenConn(10),
 		GOrmLogger(os.Stderr),
 		GOrmConnMaxLifetime(time.Second*60),
 		GOrmShowSQL(true),
 		GOrmAutoMigrate(&gOrmTestBean{}),
-		GOrmOpenRedisCache([]string{"127.0.0.1:6379"}, "", 5, time.Second*60),
+		GOrmOpenRedisCache([]string{s.Addr()}, "", 5, time.Second*60),
 	); err != nil {
 		t.Error(err)
 		t.FailNow()
@@ -66,3 +72,218 @@ func TestGOrmDB(t *testing.T) {
 	}
 	t.Log("gorm get bean2:", bean2)
 }
+
+func TestGOrmReplicaPolicy(t *testing.T) {
+	replicas := []*sql.DB{{}, {}, {}}
+	opts, err := initGOrmOptions(
+		GOrmName("replica"),
+		GOrmReplica("replica0", 1),
+		GOrmReplica("replica1", 2),
+		GOrmReplica("replica2", 0),
+	)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	policy := opts.replicaPolicy()
+	var picked []*sql.DB
+	for i := 0; i < 4; i++ {
+		picked = append(picked, policy(replicas))
+	}
+	expected := []*sql.DB{replicas[0], replicas[1], replicas[1], replicas[2]}
+	for i := range expected {
+		if picked[i] != expected[i] {
+			t.Errorf("weight round robin pick %d error", i)
+		}
+	}
+
+	if _, err := initGOrmOptions(
+		GOrmName("replica"),
+		GOrmReplica("replica0", 1),
+		GOrmUseLeastConnPolicy(),
+	); err == nil {
+		t.Error("least conn policy with replica weight should fail")
+		t.FailNow()
+	}
+}
+
+func TestGOrmReplicaRouting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "orm")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	replica, err := gorm.Open("sqlite3", filepath.Join(dir, "replica"))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if err := replica.AutoMigrate(&gOrmTestBean{}).Create(&gOrmTestBean{A: "replica"}).Error; err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	replica.Close()
+	if err := InitGOrmDB(
+		GOrmName("replica_routing"),
+		GOrmDriver("sqlite3"),
+		GOrmMaster(filepath.Join(dir, "master")),
+		GOrmReplica(filepath.Join(dir, "replica"), 0),
+		GOrmAutoMigrate(&gOrmTestBean{}),
+	); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer CloseGOrmDB("replica_routing")
+	db := GOrmDB("replica_routing")
+	if err := db.Create(&gOrmTestBean{A: "master"}).Error; err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	get := func(db *gorm.DB) string {
+		var bean gOrmTestBean
+		if err := db.First(&bean).Error; err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		return bean.A
+	}
+	if a := get(db); a != "replica" {
+		t.Errorf("query should use the replica, got %s", a)
+	}
+	if a := get(GOrmUseMaster(db)); a != "master" {
+		t.Errorf("GOrmUseMaster query should use the master, got %s", a)
+	}
+	if a := get(GOrmUseMaster(db.Set(gOrmQueryOptionKey, "/* option */"))); a != "master" {
+		t.Errorf("GOrmUseMaster should keep the query option, got %s", a)
+	}
+
+	// Raw写语句即使通过Scan执行也使用master
+	var bean gOrmTestBean
+	db.Raw("UPDATE g_orm_test_beans SET a = ?", "raw").Scan(&bean)
+	if a := get(GOrmUseMaster(db)); a != "raw" {
+		t.Errorf("raw write should use the master, got %s", a)
+	}
+	if a := get(db); a != "replica" {
+		t.Errorf("raw write should not reach the replica, got %s", a)
+	}
+
+	tx := db.Begin()
+	defer tx.Rollback()
+	if a := get(tx); a != "raw" {
+		t.Errorf("transaction should use the master, got %s", a)
+	}
+	if GOrmMasterDB("replica_routing") == nil || len(GOrmReplicas("replica_routing")) != 1 {
+		t.Error("master and replicas should be registered")
+	}
+}
+
+type gOrmTestSharding struct{}
+
+func (gOrmTestSharding) OrgName() string  { return "sharding" }
+func (gOrmTestSharding) Sharding() string { return "20060102" }
+
+func TestGOrmTimeShardingRedisLock(t *testing.T) {
+	s, client := redistest.New(t)
+	a := (&GOrmDBTimeSharding{}).RedisLock(client, time.Second)
+	b := (&GOrmDBTimeSharding{}).RedisLock(client, time.Second)
+	if ok, err := a.lock(gOrmTestSharding{}, a.lockTimeout); err != nil || !ok {
+		t.Errorf("lock %v %v", ok, err)
+		t.FailNow()
+	}
+	if ok, _ := b.lock(gOrmTestSharding{}, b.lockTimeout); ok {
+		t.Error("lock acquired twice")
+		t.FailNow()
+	}
+	s.FastForward(time.Second)
+	if ok, _ := b.lock(gOrmTestSharding{}, b.lockTimeout); !ok {
+		t.Error("lock not expired")
+		t.FailNow()
+	}
+	if err := b.unlock(gOrmTestSharding{}); err != nil || s.Exists("gorm:timesharding:sharding") {
+		t.Errorf("unlock %v", err)
+		t.FailNow()
+	}
+}
+
+type gOrmNamespaceBean struct {
+	gorm.Model
+	A string
+}
+
+func TestGOrmRedisCacheNamespace(t *testing.T) {
+	s, _ := redistest.New(t)
+	dir, err := ioutil.TempDir("", "orm")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	s.Set("other", "kept") // 其他服务的key
+	// svc_a@t1为svc_a下的租户t1
+	for _, namespace := range []string{"svc_a", "svc_b", "svc_a@t1"} {
+		cacheOptions := []GOrmRedisCacheOption{GOrmRedisCacheNamespace(namespace)}
+		if i := strings.Index(namespace, "@"); i >= 0 {
+			cacheOptions = []GOrmRedisCacheOption{GOrmRedisCacheTenant(namespace[i+1:]), GOrmRedisCacheNamespace(namespace[:i])}
+		}
+		if err := InitGOrmDB(
+			GOrmName("namespace_"+namespace),
+			GOrmDriver("sqlite3"),
+			GOrmDataSource(filepath.Join(dir, namespace)),
+			GOrmAutoMigrate(&gOrmNamespaceBean{}),
+			GOrmOpenRedisCache([]string{s.Addr()}, "", 0, time.Minute, cacheOptions...),
+		); err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		defer CloseGOrmDB("namespace_" + namespace)
+		db := GOrmDB("namespace_" + namespace)
+		if err := db.Create(&gOrmNamespaceBean{A: namespace}).Error; err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		var bean gOrmNamespaceBean
+		if err := db.Where("id = ?", 1).First(&bean).Error; err != nil || bean.A != namespace {
+			t.Errorf("query %s got %v: %v", namespace, bean.A, err)
+			t.FailNow()
+		}
+	}
+	keys := func(prefix string) (n int) {
+		for _, key := range s.Keys() {
+			if strings.HasPrefix(key, prefix) {
+				n++
+			}
+		}
+		return
+	}
+	if keys("svc_a:") == 0 || keys("svc_b:") == 0 || keys("svc_a@t1:") == 0 ||
+		keys("svc_a:")+keys("svc_b:")+keys("svc_a@t1:")+1 != len(s.Keys()) {
+		t.Errorf("keys should be prefixed by the namespace: %v", s.Keys())
+		t.FailNow()
+	}
+
+	a, b := GOrmDB("namespace_svc_a"), GOrmDB("namespace_svc_b")
+	if err := a.Model(&gOrmNamespaceBean{}).Where("id = ?", 1).Update("a", "updated").Error; err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	var bean gOrmNamespaceBean
+	if err := a.Where("id = ?", 1).First(&bean).Error; err != nil || bean.A != "updated" {
+		t.Errorf("query after update got %v: %v", bean.A, err)
+		t.FailNow()
+	}
+	if err := b.Where("id = ?", 1).First(&bean).Error; err != nil || bean.A != "svc_b" {
+		t.Errorf("other namespace got %v: %v", bean.A, err)
+		t.FailNow()
+	}
+
+	// FlushDB只清除自己namespace下的key
+	if err := GOrmRedisCacheDB("namespace_svc_a").FlushDB(); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if keys("svc_a:") != 0 || keys("svc_b:") == 0 || keys("svc_a@t1:") == 0 || !s.Exists("other") {
+		t.Errorf("FlushDB should only clear its namespace: %v", s.Keys())
+		t.FailNow()
+	}
+}
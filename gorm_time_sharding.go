@@ -5,20 +5,31 @@ import (
 	"github.com/go-redis/redis"
 	"github.com/jinzhu/gorm"
 	"log"
+	"sync"
 	"time"
 )
 
+var gOrmTimeShardings sync.Map // make(map[*GOrmDBTimeSharding]struct{})
+
 type GOrmTimeSharding interface {
 	OrgName() string
 	Sharding() string
 }
 
+// GOrmRedisLocker 分表时使用的分布式锁, *redis.Client, *redis.ClusterClient等都满足该接口
+type GOrmRedisLocker interface {
+	SetNX(key string, value interface{}, expiration time.Duration) *redis.BoolCmd
+	Del(keys ...string) *redis.IntCmd
+}
+
 type GOrmDBTimeSharding struct {
 	db          *gorm.DB
 	tables      map[string]GOrmTimeSharding
 	records     map[string]bool
-	redisClient *redis.Client
+	redisClient GOrmRedisLocker
 	lockTimeout time.Duration
+	done        chan struct{}
+	closeOnce   sync.Once
 }
 
 func NewGOrmDBTimeSharding(db *gorm.DB) *GOrmDBTimeSharding {
@@ -26,12 +37,22 @@ func NewGOrmDBTimeSharding(db *gorm.DB) *GOrmDBTimeSharding {
 		db:      db,
 		tables:  make(map[string]GOrmTimeSharding),
 		records: make(map[string]bool),
+		done:    make(chan struct{}),
 	}
+	gOrmTimeShardings.Store(s, struct{}{})
 	go s.startAutoShardingTimer()
 	return s
 }
 
-func (s *GOrmDBTimeSharding) RedisLock(client *redis.Client, timeout time.Duration) *GOrmDBTimeSharding {
+// Close 停止自动建表定时器
+func (s *GOrmDBTimeSharding) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		gOrmTimeShardings.Delete(s)
+	})
+}
+
+func (s *GOrmDBTimeSharding) RedisLock(client GOrmRedisLocker, timeout time.Duration) *GOrmDBTimeSharding {
 	s.redisClient = client
 	s.lockTimeout = timeout
 	return s
@@ -106,8 +127,11 @@ func (s *GOrmDBTimeSharding) autoMigrate(t GOrmTimeSharding, shardingTime time.T
 
 func (s *GOrmDBTimeSharding) startAutoShardingTimer() {
 	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
 	for {
 		select {
+		case <-s.done:
+			return
 		case <-timer.C:
 			for _, sharding := range s.tables {
 				if err := s.createSharding(sharding); err != nil {
@@ -0,0 +1,185 @@
+package orm
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-xorm/xorm"
+)
+
+var errHealthNotFound = errors.New("not registered")
+
+// Health 单个db, engine, engine group或redis连接的检查结果
+type Health struct {
+	Name    string        // like "gorm:default", "xorm:default", "xorm_group:default", "xorm_redis:127.0.0.1:6379/10#1"
+	Err     error         // ping错误, nil表示可用
+	Latency time.Duration // ping耗时
+	Stats   *sql.DBStats  // 连接池状态, redis为nil
+	Slaves  []*Health     // 仅engine group和配置了从库的gorm db,每个slave的检查结果
+}
+
+func (h *Health) Healthy() bool {
+	return h.Err == nil
+}
+
+// ReachableSlaves 返回engine group中可用的slave下标
+func (h *Health) ReachableSlaves() []int {
+	var reachable []int
+	for i, slave := range h.Slaves {
+		if slave.Healthy() {
+			reachable = append(reachable, i)
+		}
+	}
+	return reachable
+}
+
+// HealthCheck 检查所有已注册的gorm db, xorm engine, xorm engine group成员及redis cache连接
+// 返回 名称 => 错误, engine group的slave以 "xorm_group:name/slave0" 的形式单独列出, gorm从库为 "gorm:name/replica0"
+func HealthCheck(ctx context.Context) map[string]error {
+	result := make(map[string]error)
+	for name, h := range HealthReport(ctx) {
+		result[name] = h.Err
+		for _, slave := range h.Slaves {
+			result[slave.Name] = slave.Err
+		}
+	}
+	return result
+}
+
+// HealthReport 并发检查所有已注册的连接,返回 名称 => 检查结果
+func HealthReport(ctx context.Context) map[string]*Health {
+	var checks []func() *Health
+	gOrmDB.Range(func(key, value interface{}) bool {
+		name, o := key.(string), value.(*gOrm)
+		checks = append(checks, func() *Health { return gOrmHealth(ctx, name, o) })
+		if client := gOrmRedisCacheClient(o.redisCache); client != nil {
+			checks = append(checks, func() *Health {
+				return redisHealth(ctx, "gorm_redis:"+name, client.Ping().Err)
+			})
+		}
+		return true
+	})
+	xOrmEngine.Range(func(key, value interface{}) bool {
+		name, engine := key.(string), value.(*xorm.Engine)
+		checks = append(checks, func() *Health { return xOrmHealth(ctx, "xorm:"+name, engine) })
+		return true
+	})
+	xOrmEngineGroup.Range(func(key, value interface{}) bool {
+		name, group := key.(string), value.(*xOrmGroup)
+		checks = append(checks, func() *Health { return xOrmGroupHealth(ctx, name, group) })
+		return true
+	})
+	xOrmRedisCaches.Range(func(key, value interface{}) bool {
+		cache, id := key.(*xOrmRedisCache), value.(uint64)
+		checks = append(checks, func() *Health { // 同一个redis库上可以有多个cache, 以创建序号区分
+			return redisHealth(ctx, fmt.Sprintf("xorm_redis:%s#%d", cache.addr, id), cache.client.Ping().Err)
+		})
+		return true
+	})
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	report := make(map[string]*Health, len(checks))
+	for _, check := range checks {
+		wg.Add(1)
+		go func(check func() *Health) {
+			defer wg.Done()
+			h := check()
+			mu.Lock()
+			report[h.Name] = h
+			mu.Unlock()
+		}(check)
+	}
+	wg.Wait()
+	return report
+}
+
+// GOrmHealthCheck 检查指定名称的gorm db
+func GOrmHealthCheck(ctx context.Context, name string) *Health {
+	if i, ok := gOrmDB.Load(name); ok && i != nil {
+		return gOrmHealth(ctx, name, i.(*gOrm))
+	}
+	return &Health{Name: "gorm:" + name, Err: errHealthNotFound}
+}
+
+// XOrmHealthCheck 检查指定名称的xorm engine
+func XOrmHealthCheck(ctx context.Context, name string) *Health {
+	if engine := XOrmEngine(name); engine != nil {
+		return xOrmHealth(ctx, "xorm:"+name, engine)
+	}
+	return &Health{Name: "xorm:" + name, Err: errHealthNotFound}
+}
+
+// XOrmGroupHealthCheck 检查指定名称的xorm engine group的master以及所有slave
+func XOrmGroupHealthCheck(ctx context.Context, name string) *Health {
+	if group := xOrmGroupLoad(name); group != nil {
+		return xOrmGroupHealth(ctx, name, group)
+	}
+	return &Health{Name: "xorm_group:" + name, Err: errHealthNotFound}
+}
+
+func gOrmHealth(ctx context.Context, name string, o *gOrm) *Health {
+	h := sqlHealth(ctx, "gorm:"+name, o.master)
+	if len(o.replicas) == 0 {
+		return h
+	}
+	h.Slaves = make([]*Health, len(o.replicas))
+	var wg sync.WaitGroup
+	for i, replica := range o.replicas {
+		wg.Add(1)
+		go func(i int, replica *sql.DB) {
+			defer wg.Done()
+			h.Slaves[i] = sqlHealth(ctx, fmt.Sprintf("gorm:%s/replica%d", name, i), replica)
+		}(i, replica)
+	}
+	wg.Wait()
+	return h
+}
+
+func xOrmHealth(ctx context.Context, name string, engine *xorm.Engine) *Health {
+	return sqlHealth(ctx, name, engine.DB().DB)
+}
+
+func xOrmGroupHealth(ctx context.Context, name string, group *xOrmGroup) *Health {
+	slaves := group.slaves()
+	h := xOrmHealth(ctx, "xorm_group:"+name, group.opts.master)
+	h.Slaves = make([]*Health, len(slaves))
+	var wg sync.WaitGroup
+	for i, slave := range slaves {
+		wg.Add(1)
+		go func(i int, slave *xorm.Engine) {
+			defer wg.Done()
+			h.Slaves[i] = xOrmHealth(ctx, fmt.Sprintf("xorm_group:%s/slave%d", name, i), slave)
+		}(i, slave)
+	}
+	wg.Wait()
+	return h
+}
+
+func sqlHealth(ctx context.Context, name string, db *sql.DB) *Health {
+	if db == nil {
+		return &Health{Name: name, Err: errors.New("sql db is nil")}
+	}
+	start := time.Now()
+	err := db.PingContext(ctx)
+	stats := db.Stats()
+	return &Health{Name: name, Err: err, Latency: time.Since(start), Stats: &stats}
+}
+
+// go-redis v6的Ping不支持ctx,在ctx结束时直接返回ctx.Err()
+func redisHealth(ctx context.Context, name string, ping func() error) *Health {
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- ping() }()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	return &Health{Name: name, Err: err, Latency: time.Since(start)}
+}
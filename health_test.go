@@ -0,0 +1,79 @@
+package orm
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/marcosxz/orm/internal/redistest"
+)
+
+func TestHealthCheck(t *testing.T) {
+	for _, name := range []string{"health_master", "health_slave"} {
+		if err := InitXOrmEngine(
+			XOrmEngineName(name),
+			XOrmDriver("mysql"),
+			XOrmDataSource("root:root@tcp(127.0.0.1:1)/test?timeout=1s"),
+		); err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+	}
+	if err := InitXOrmEngineGroup(
+		XOrmGroupName("health_group"),
+		XOrmMaster(XOrmEngine("health_master")),
+		XOrmSlave(XOrmEngine("health_slave"), 0),
+	); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer CloseAll(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	result := HealthCheck(ctx)
+	for _, name := range []string{"xorm:health_master", "xorm:health_slave", "xorm_group:health_group", "xorm_group:health_group/slave0"} {
+		if err, ok := result[name]; !ok || err == nil {
+			t.Errorf("%s should be unhealthy, got: %v", name, err)
+		}
+	}
+
+	h := XOrmGroupHealthCheck(ctx, "health_group")
+	if h.Healthy() || h.Stats == nil || len(h.Slaves) != 1 || len(h.ReachableSlaves()) != 0 {
+		t.Errorf("unexpected group health: %+v", h)
+	}
+	if h := GOrmHealthCheck(ctx, "health_none"); h.Err != errHealthNotFound {
+		t.Errorf("unregistered gorm db should be not found, got: %v", h.Err)
+	}
+}
+
+func TestHealthCheckRedis(t *testing.T) {
+	s, client := redistest.New(t)
+	a, err := NewXOrmRedisCacheClient(client, time.Minute, XOrmRedisCacheNamespace("a"))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer a.Close()
+	b, err := NewXOrmRedisCacheClient(redis.NewClient(&redis.Options{Addr: s.Addr()}), time.Minute, XOrmRedisCacheNamespace("b"))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer b.Close()
+
+	count := 0
+	for name, h := range HealthReport(context.Background()) {
+		if strings.HasPrefix(name, "xorm_redis:"+a.addr+"#") {
+			count++
+			if !h.Healthy() {
+				t.Errorf("%s should be healthy, got: %v", name, h.Err)
+			}
+		}
+	}
+	if count != 2 {
+		t.Errorf("caches on the same redis db should be reported separately, got %d", count)
+	}
+}
@@ -0,0 +1,19 @@
+// Package redistest 启动进程内的redis, 由orm包内的测试与ormtest共用
+// orm包内的测试不能引入ormtest(ormtest依赖orm), 因此放在不依赖orm的内部包中
+package redistest
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis"
+)
+
+// New 启动进程内的redis并创建连接, 测试结束时关闭
+func New(t testing.TB) (*miniredis.Miniredis, *redis.Client) {
+	t.Helper()
+	s := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	t.Cleanup(func() { _ = client.Close() })
+	return s, client
+}
@@ -0,0 +1,129 @@
+package orm
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// DrainTimeout 连接池被替换后,等待旧连接池上正在执行的查询结束的最长时间
+var DrainTimeout = time.Second * 30
+
+const drainInterval = time.Millisecond * 100
+
+// 汇总多个关闭/检查错误
+type ormErrors []error
+
+func (e ormErrors) Error() string {
+	ss := make([]string, 0, len(e))
+	for _, err := range e {
+		ss = append(ss, err.Error())
+	}
+	return strings.Join(ss, "; ")
+}
+
+func (e ormErrors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// WITH语句中出现的写关键字, 包括CTE之后的主语句
+var ormWriteSQLRegexp = regexp.MustCompile(`\b(INSERT|UPDATE|DELETE|REPLACE|MERGE)\b`)
+
+// 只读语句: SELECT(不含FOR UPDATE/FOR SHARE/LOCK IN SHARE MODE), 不含写语句的WITH, SHOW, DESCRIBE, EXPLAIN
+func ormIsReadSQL(sql string) bool {
+	s := strings.ToUpper(strings.TrimLeft(sql, " \t\r\n("))
+	switch {
+	case strings.HasPrefix(s, "WITH") && ormWriteSQLRegexp.MatchString(s):
+		return false
+	case strings.HasPrefix(s, "SELECT"), strings.HasPrefix(s, "WITH"):
+		return !strings.Contains(s, "FOR UPDATE") && !strings.Contains(s, "FOR SHARE") && !strings.Contains(s, "LOCK IN SHARE MODE")
+	case strings.HasPrefix(s, "SHOW"), strings.HasPrefix(s, "DESC"), strings.HasPrefix(s, "EXPLAIN"):
+		return true
+	}
+	return false
+}
+
+// CloseAll 关闭所有已注册的gorm db, xorm engine, xorm engine group, redis cache, 缓存失效通知总线以及分表定时器
+// 如果ctx先结束则返回ctx.Err(),剩余的关闭操作仍会在后台完成
+func CloseAll(ctx context.Context) error {
+	done := make(chan error, 1)
+	go func() { done <- closeAll() }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func closeAll() error {
+	var errs ormErrors
+	configWatchers.Range(func(key, value interface{}) bool {
+		key.(*configWatcher).stop()
+		return true
+	})
+	xOrmEngineGroup.Range(func(key, value interface{}) bool {
+		if err := CloseXOrmEngineGroup(key.(string)); err != nil {
+			errs = append(errs, fmt.Errorf("close xorm engine group '%s' error: %v", key, err))
+		}
+		return true
+	})
+	xOrmEngine.Range(func(key, value interface{}) bool {
+		if err := CloseXOrmEngine(key.(string)); err != nil {
+			errs = append(errs, fmt.Errorf("close xorm engine '%s' error: %v", key, err))
+		}
+		return true
+	})
+	gOrmDB.Range(func(key, value interface{}) bool {
+		if err := CloseGOrmDB(key.(string)); err != nil {
+			errs = append(errs, fmt.Errorf("close gorm db '%s' error: %v", key, err))
+		}
+		return true
+	})
+	gOrmTimeShardings.Range(func(key, value interface{}) bool {
+		key.(*GOrmDBTimeSharding).Close()
+		return true
+	})
+	xOrmCacheBuses.Range(func(key, value interface{}) bool {
+		if err := key.(*xOrmCacheBus).Close(); err != nil {
+			errs = append(errs, err)
+		}
+		return true
+	})
+	xOrmRedisCaches.Range(func(key, value interface{}) bool {
+		if err := key.(*xOrmRedisCache).Close(); err != nil {
+			errs = append(errs, err)
+		}
+		return true
+	})
+	return errs.err()
+}
+
+// 在后台等待dbs上没有正在使用的连接(最长DrainTimeout)后调用closer关闭, DrainTimeout在调用时读取
+func drainClose(desc string, closer func() error, dbs ...*sql.DB) {
+	deadline := time.Now().Add(DrainTimeout)
+	go func() {
+		for time.Now().Before(deadline) {
+			time.Sleep(drainInterval)
+			inUse := 0
+			for _, db := range dbs {
+				if db != nil {
+					inUse += db.Stats().InUse
+				}
+			}
+			if inUse == 0 {
+				break
+			}
+		}
+		if err := closer(); err != nil {
+			log.Printf("[ERROR] close replaced %s error: %v", desc, err)
+		}
+	}()
+}
@@ -0,0 +1,45 @@
+package orm
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCloseAll(t *testing.T) {
+	for _, name := range []string{"close_master", "close_slave"} {
+		if err := InitXOrmEngine(
+			XOrmEngineName(name),
+			XOrmDriver("mysql"),
+			XOrmDataSource("root:root@tcp(127.0.0.1:3306)/test?charset=utf8"),
+		); err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+	}
+	if err := InitXOrmEngineGroup(
+		XOrmGroupName("close_group"),
+		XOrmMaster(XOrmEngine("close_master")),
+		XOrmSlave(XOrmEngine("close_slave"), 0),
+	); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	sharding := NewGOrmDBTimeSharding(nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err := CloseAll(ctx); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if XOrmEngine("close_master") != nil || XOrmEngine("close_slave") != nil {
+		t.Error("xorm engine still registered after CloseAll")
+	}
+	if XOrmEngineGroup("close_group") != nil {
+		t.Error("xorm engine group still registered after CloseAll")
+	}
+	if _, ok := gOrmTimeShardings.Load(sharding); ok {
+		t.Error("gorm time sharding still registered after CloseAll")
+	}
+}
@@ -0,0 +1,259 @@
+package orm
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/go-xorm/xorm"
+	"github.com/jinzhu/gorm"
+	"xorm.io/core"
+)
+
+// 绑定了事务的名称, 用于测试隔离
+var (
+	gOrmTxs sync.Map // make(map[string]*gorm.DB)
+	xOrmTxs sync.Map // make(map[string]*xorm.Engine)
+)
+
+// GOrmBindTx 在name的gorm db上开启事务, rollback之前GOrmDB(name)返回运行在该事务中的*gorm.DB
+// 被测代码的Begin/Commit/Rollback使用savepoint, 不会结束事务; 事务中不使用缓存以及读写分离
+// 同一个名称同时只能绑定一个事务, 不能用于并行的测试
+func GOrmBindTx(name string) (rollback func() error, err error) {
+	i, ok := gOrmDB.Load(name)
+	if !ok || i == nil {
+		return nil, fmt.Errorf("gorm db '%s' not found", name)
+	}
+	o := i.(*gOrm)
+	tx, err := openOrmTx(o.driver, o.dataSource)
+	if err != nil {
+		return nil, err
+	}
+	db, err := gorm.Open(o.db.Dialect().GetName(), tx.db)
+	if err != nil {
+		tx.close()
+		return nil, err
+	}
+	if o.logger != nil {
+		db.SetLogger(o.logger)
+	}
+	if _, loaded := gOrmTxs.LoadOrStore(name, db); loaded {
+		tx.close()
+		return nil, fmt.Errorf("gorm db '%s' already bound to a transaction", name)
+	}
+	return func() error {
+		gOrmTxs.Delete(name)
+		return tx.close()
+	}, nil
+}
+
+// XOrmBindTx 在name的xorm engine上开启事务, rollback之前XOrmEngine(name)以及XOrmSession(name)运行在该事务中
+// 被测代码的Begin/Commit/Rollback使用savepoint, 不会结束事务; 事务中不使用缓存, engine group不受影响
+// 同一个名称同时只能绑定一个事务, 不能用于并行的测试
+func XOrmBindTx(name string) (rollback func() error, err error) {
+	i, ok := xOrmEngine.Load(name)
+	if !ok || i == nil {
+		return nil, fmt.Errorf("xorm engine '%s' not found", name)
+	}
+	engine := i.(*xorm.Engine)
+	tx, err := openOrmTx(engine.DriverName(), engine.DataSourceName())
+	if err != nil {
+		return nil, err
+	}
+	bound, err := xOrmTxEngine(engine, tx.db)
+	if err != nil {
+		tx.close()
+		return nil, err
+	}
+	if _, loaded := xOrmTxs.LoadOrStore(name, bound); loaded {
+		tx.close()
+		return nil, fmt.Errorf("xorm engine '%s' already bound to a transaction", name)
+	}
+	return func() error {
+		xOrmTxs.Delete(name)
+		return tx.close()
+	}, nil
+}
+
+// xorm的engine不能基于已有的*sql.DB创建, 这里复制engine并通过反射替换db以及dialect, 清空缓存
+func xOrmTxEngine(engine *xorm.Engine, db *sql.DB) (*xorm.Engine, error) {
+	dialect := core.QueryDialect(engine.Dialect().DBType())
+	if dialect == nil {
+		return nil, fmt.Errorf("unsupported dialect type: %v", engine.Dialect().DBType())
+	}
+	coreDB := core.FromDB(db)
+	coreDB.Mapper = engine.DB().Mapper
+	if err := dialect.Init(coreDB, engine.Dialect().URI(), engine.DriverName(), engine.DataSourceName()); err != nil {
+		return nil, err
+	}
+	bound := new(xorm.Engine)
+	v := reflect.ValueOf(bound).Elem()
+	v.Set(reflect.ValueOf(engine).Elem())
+	xOrmField(v, "db").Set(reflect.ValueOf(coreDB))
+	xOrmField(v, "dialect").Set(reflect.ValueOf(dialect))
+	xOrmField(v, "cachers").Set(reflect.ValueOf(make(map[string]core.Cacher)))
+	for _, name := range []string{"cacherLock", "engineGroup"} {
+		field := xOrmField(v, name)
+		field.Set(reflect.Zero(field.Type()))
+	}
+	bound.SetDefaultCacher(nil)
+	return bound, nil
+}
+
+func xOrmField(v reflect.Value, name string) reflect.Value {
+	field := v.FieldByName(name)
+	return reflect.NewAt(field.Type(), unsafe.Pointer(field.UnsafeAddr())).Elem()
+}
+
+// 绑定的事务, db的所有连接共享同一个处于事务中的数据库连接
+// db上开启的事务使用savepoint, 提交或回滚只释放或回滚到savepoint, close时回滚整个事务
+// 共享的连接不能并发使用, 与直接使用*sql.Tx相同
+type ormTx struct {
+	driver    driver.Driver
+	mu        sync.Mutex
+	conn      driver.Conn
+	tx        driver.Tx
+	savepoint int64
+	db        *sql.DB
+}
+
+func openOrmTx(driverName, dataSource string) (*ormTx, error) {
+	db, err := sql.Open(driverName, dataSource)
+	if err != nil {
+		return nil, err
+	}
+	t := &ormTx{driver: db.Driver()}
+	_ = db.Close()
+	if t.conn, err = t.driver.Open(dataSource); err != nil {
+		return nil, err
+	}
+	if begin, ok := t.conn.(driver.ConnBeginTx); ok {
+		t.tx, err = begin.BeginTx(context.Background(), driver.TxOptions{})
+	} else {
+		t.tx, err = t.conn.Begin()
+	}
+	if err != nil {
+		_ = t.conn.Close()
+		return nil, err
+	}
+	t.db = sql.OpenDB(t)
+	return t, nil
+}
+
+func (t *ormTx) Connect(context.Context) (driver.Conn, error) { return &ormTxConn{t}, nil }
+func (t *ormTx) Driver() driver.Driver                        { return t.driver }
+
+func (t *ormTx) exec(query string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if execer, ok := t.conn.(driver.ExecerContext); ok {
+		if _, err := execer.ExecContext(context.Background(), query, nil); err != driver.ErrSkip {
+			return err
+		}
+	}
+	stmt, err := t.conn.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(nil)
+	return err
+}
+
+func (t *ormTx) close() error {
+	var errs ormErrors
+	if err := t.db.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.tx.Rollback(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := t.conn.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	return errs.err()
+}
+
+type ormTxConn struct {
+	tx *ormTx
+}
+
+func (c *ormTxConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *ormTxConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	c.tx.mu.Lock()
+	defer c.tx.mu.Unlock()
+	if prepare, ok := c.tx.conn.(driver.ConnPrepareContext); ok {
+		return prepare.PrepareContext(ctx, query)
+	}
+	return c.tx.conn.Prepare(query)
+}
+
+// 共享的连接在ormTx.close时关闭
+func (c *ormTxConn) Close() error { return nil }
+
+func (c *ormTxConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+// 隔离级别以及只读由外层事务决定
+func (c *ormTxConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	name := fmt.Sprintf("orm_tx_%d", atomic.AddInt64(&c.tx.savepoint, 1))
+	if err := c.tx.exec("SAVEPOINT " + name); err != nil {
+		return nil, err
+	}
+	return &ormTxSavepoint{tx: c.tx, name: name}, nil
+}
+
+func (c *ormTxConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.tx.conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	c.tx.mu.Lock()
+	defer c.tx.mu.Unlock()
+	return execer.ExecContext(ctx, query, args)
+}
+
+func (c *ormTxConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.tx.conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	c.tx.mu.Lock()
+	defer c.tx.mu.Unlock()
+	return queryer.QueryContext(ctx, query, args)
+}
+
+// 使用驱动自己的参数转换
+func (c *ormTxConn) CheckNamedValue(value *driver.NamedValue) error {
+	if checker, ok := c.tx.conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(value)
+	}
+	return driver.ErrSkip
+}
+
+type ormTxSavepoint struct {
+	tx   *ormTx
+	name string
+}
+
+func (s *ormTxSavepoint) Commit() error {
+	return s.tx.exec("RELEASE SAVEPOINT " + s.name)
+}
+
+func (s *ormTxSavepoint) Rollback() error {
+	if err := s.tx.exec("ROLLBACK TO SAVEPOINT " + s.name); err != nil {
+		return err
+	}
+	return s.tx.exec("RELEASE SAVEPOINT " + s.name)
+}
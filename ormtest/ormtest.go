@@ -0,0 +1,148 @@
+// Package ormtest 为使用orm的测试提供不依赖外部服务的数据库以及redis
+// gorm/xorm使用内存中的SQLite, engine group使用多个SQLite文件模拟master与slave, redis使用miniredis
+// 所有资源以测试中给定的名称注册到orm, 测试结束时关闭并注销
+package ormtest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis"
+	"github.com/go-xorm/xorm"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/marcosxz/orm"
+	"github.com/marcosxz/orm/internal/redistest"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const Driver = "sqlite3"
+
+var memoryID int64
+
+// MemoryDataSource 返回一个新的内存数据库, 同一个数据源的连接共享同一个数据库, 所有连接关闭后数据库被释放
+func MemoryDataSource(name string) string {
+	id := atomic.AddInt64(&memoryID, 1)
+	name = strings.NewReplacer("/", "_", " ", "_", "?", "_", "#", "_").Replace(name)
+	return fmt.Sprintf("file:%s_%d?mode=memory&cache=shared&_busy_timeout=5000", name, id)
+}
+
+// GOrm 以name注册内存SQLite的gorm db并迁移beans, options在默认选项之后生效
+func GOrm(t testing.TB, name string, beans []interface{}, options ...orm.GOrmOptions) *gorm.DB {
+	t.Helper()
+	if err := orm.InitGOrmDB(append([]orm.GOrmOptions{
+		orm.GOrmName(name),
+		orm.GOrmDriver(Driver),
+		orm.GOrmDataSource(MemoryDataSource(t.Name())),
+		orm.GOrmAutoMigrate(beans...),
+	}, options...)...); err != nil {
+		t.Fatalf("ormtest: init gorm db '%s' error: %v", name, err)
+	}
+	t.Cleanup(func() {
+		if err := orm.CloseGOrmDB(name); err != nil {
+			t.Errorf("ormtest: close gorm db '%s' error: %v", name, err)
+		}
+	})
+	return orm.GOrmDB(name)
+}
+
+// XOrm 以name注册内存SQLite的xorm engine并同步beans, options在默认选项之后生效
+func XOrm(t testing.TB, name string, beans []interface{}, options ...orm.XOrmOption) *xorm.Engine {
+	t.Helper()
+	return xOrm(t, name, MemoryDataSource(t.Name()), beans, options...)
+}
+
+func xOrm(t testing.TB, name, dataSource string, beans []interface{}, options ...orm.XOrmOption) *xorm.Engine {
+	t.Helper()
+	if err := orm.InitXOrmEngine(append([]orm.XOrmOption{
+		orm.XOrmEngineName(name),
+		orm.XOrmDriver(Driver),
+		orm.XOrmDataSource(dataSource),
+		orm.XOrmSync2(beans...),
+	}, options...)...); err != nil {
+		t.Fatalf("ormtest: init xorm engine '%s' error: %v", name, err)
+	}
+	t.Cleanup(func() {
+		if err := orm.CloseXOrmEngine(name); err != nil {
+			t.Errorf("ormtest: close xorm engine '%s' error: %v", name, err)
+		}
+	})
+	return orm.XOrmEngine(name)
+}
+
+// XOrmGroup 以name注册engine group, master与slaves个slave分别为临时目录中的SQLite文件
+// 文件之间没有复制, 需要slave上的数据时通过orm.XOrmEngineSlaves直接写入
+// master与slave同时以 name/master, name/slave0 ... 注册为engine
+func XOrmGroup(t testing.TB, name string, slaves int, beans []interface{}, options ...orm.XOrmGroupOption) *xorm.EngineGroup {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "ormtest")
+	if err != nil {
+		t.Fatalf("ormtest: create temp dir error: %v", err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+
+	file := func(file string) string {
+		return "file:" + filepath.Join(dir, file) + "?_busy_timeout=5000"
+	}
+	groupOptions := []orm.XOrmGroupOption{
+		orm.XOrmGroupName(name),
+		orm.XOrmMaster(xOrm(t, name+"/master", file("master.db"), beans)),
+	}
+	for i := 0; i < slaves; i++ {
+		slave := xOrm(t, fmt.Sprintf("%s/slave%d", name, i), file(fmt.Sprintf("slave%d.db", i)), beans)
+		groupOptions = append(groupOptions, orm.XOrmSlave(slave, 1))
+	}
+	if err := orm.InitXOrmEngineGroup(append(groupOptions, options...)...); err != nil {
+		t.Fatalf("ormtest: init xorm engine group '%s' error: %v", name, err)
+	}
+	t.Cleanup(func() {
+		if err := orm.CloseXOrmEngineGroup(name); err != nil {
+			t.Errorf("ormtest: close xorm engine group '%s' error: %v", name, err)
+		}
+	})
+	return orm.XOrmEngineGroup(name)
+}
+
+// Redis 启动进程内的redis, 可用于orm.NewXOrmRedisCacheClient, orm.GOrmOpenRedisCache以及分表的RedisLock
+func Redis(t testing.TB) (*miniredis.Miniredis, *redis.Client) {
+	t.Helper()
+	return redistest.New(t)
+}
+
+// GOrmTx 在name的gorm db上开启事务, 测试期间orm.GOrmDB(name)返回运行在该事务中的db, 测试结束时回滚
+// 被测代码的Begin/Commit/Rollback使用savepoint, 同一个名称同时只能绑定一个事务, 不能在并行的测试中使用
+func GOrmTx(t testing.TB, name string) *gorm.DB {
+	t.Helper()
+	rollback, err := orm.GOrmBindTx(name)
+	if err != nil {
+		t.Fatalf("ormtest: begin gorm db '%s' error: %v", name, err)
+	}
+	t.Cleanup(func() {
+		if err := rollback(); err != nil {
+			t.Errorf("ormtest: rollback gorm db '%s' error: %v", name, err)
+		}
+	})
+	return orm.GOrmDB(name)
+}
+
+// XOrmTx 在name的xorm engine上开启事务, 测试期间orm.XOrmEngine(name)以及orm.XOrmSession(name)运行在该事务中, 测试结束时回滚
+// 被测代码的Begin/Commit/Rollback使用savepoint, 见orm.XOrmBindTx
+func XOrmTx(t testing.TB, name string) *xorm.Session {
+	t.Helper()
+	rollback, err := orm.XOrmBindTx(name)
+	if err != nil {
+		t.Fatalf("ormtest: begin xorm engine '%s' error: %v", name, err)
+	}
+	t.Cleanup(func() {
+		if err := rollback(); err != nil {
+			t.Errorf("ormtest: rollback xorm engine '%s' error: %v", name, err)
+		}
+	})
+	return orm.XOrmSession(name)
+}
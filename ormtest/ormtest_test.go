@@ -0,0 +1,190 @@
+package ormtest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/marcosxz/orm"
+)
+
+type gOrmBean struct {
+	gorm.Model
+	A string
+}
+
+type xOrmBean struct {
+	Id int64
+	A  string
+}
+
+var xOrmBeanInserted int
+
+func (*xOrmBean) AfterInsert() { xOrmBeanInserted++ }
+
+func TestGOrm(t *testing.T) {
+	db := GOrm(t, "ormtest", []interface{}{&gOrmBean{}})
+	if orm.GOrmDB("ormtest") != db {
+		t.Fatal("gorm db not registered")
+	}
+	if err := db.Create(&gOrmBean{A: "a"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	var bean gOrmBean
+	if err := db.First(&bean, "a = ?", "a").Error; err != nil || bean.ID == 0 {
+		t.Fatalf("first %+v %v", bean, err)
+	}
+	t.Run("isolated", func(t *testing.T) {
+		var count int
+		if err := GOrm(t, "ormtest_sub", []interface{}{&gOrmBean{}}).Model(&gOrmBean{}).Count(&count).Error; err != nil || count != 0 {
+			t.Fatalf("count %d %v", count, err)
+		}
+	})
+	if orm.GOrmDB("ormtest_sub") != nil {
+		t.Fatal("gorm db not closed after subtest")
+	}
+}
+
+func TestXOrm(t *testing.T) {
+	_, client := Redis(t)
+	cache, err := orm.NewXOrmRedisCacheClient(client, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine := XOrm(t, "ormtest", []interface{}{&xOrmBean{}}, orm.XOrmDefaultCache(cache))
+	if _, err := engine.Insert(&xOrmBean{A: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ { // 第二次从缓存读取
+		bean := &xOrmBean{Id: 1}
+		if has, err := engine.Get(bean); err != nil || !has || bean.A != "a" {
+			t.Fatalf("get %+v %v %v", bean, has, err)
+		}
+	}
+	if stats := cache.Stats()["x_orm_bean"]; stats.Hits == 0 || stats.Puts == 0 {
+		t.Fatalf("cache not used %+v", stats)
+	}
+}
+
+func TestXOrmGroup(t *testing.T) {
+	group := XOrmGroup(t, "ormtest", 2, []interface{}{&xOrmBean{}})
+	if _, err := group.Insert(&xOrmBean{A: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	slaves := orm.XOrmEngineSlaves("ormtest")
+	if len(slaves) != 2 || orm.XOrmEngine("ormtest/slave1") != slaves[1] {
+		t.Fatalf("slaves %v", slaves)
+	}
+	if n, err := slaves[0].Count(&xOrmBean{}); err != nil || n != 0 {
+		t.Fatalf("slave count %d %v", n, err)
+	}
+	if n, err := orm.XOrmEngineMaster("ormtest").Count(&xOrmBean{}); err != nil || n != 1 {
+		t.Fatalf("master count %d %v", n, err)
+	}
+	// 注销分组仍在使用的engine时不关闭连接池
+	if err := orm.CloseXOrmEngine("ormtest/master"); err != nil {
+		t.Fatal(err)
+	}
+	if err := orm.InitXOrmEngine(orm.XOrmEngineName("ormtest/slave0"), orm.XOrmDriver(Driver), orm.XOrmDataSource(MemoryDataSource(t.Name()))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := group.Insert(&xOrmBean{A: "b"}); err != nil {
+		t.Fatalf("master closed while used by the group: %v", err)
+	}
+	time.Sleep(time.Millisecond * 300) // 等待替换的engine排空
+	if n, err := slaves[0].Count(&xOrmBean{}); err != nil || n != 0 {
+		t.Fatalf("slave closed while used by the group: %d %v", n, err)
+	}
+}
+
+func TestGOrmTx(t *testing.T) {
+	db := GOrm(t, "ormtest", []interface{}{&gOrmBean{}})
+	t.Run("tx", func(t *testing.T) {
+		tx := GOrmTx(t, "ormtest")
+		if orm.GOrmDB("ormtest") != tx {
+			t.Fatal("gorm db not bound to the transaction")
+		}
+		if err := orm.GOrmDB("ormtest").Create(&gOrmBean{A: "a"}).Error; err != nil {
+			t.Fatal(err)
+		}
+		var count int
+		if err := orm.GOrmDB("ormtest").Model(&gOrmBean{}).Count(&count).Error; err != nil || count != 1 {
+			t.Fatalf("count in tx %d %v", count, err)
+		}
+		if _, err := orm.GOrmBindTx("ormtest"); err == nil {
+			t.Fatal("bound twice")
+		}
+
+		// 被测代码自己的事务
+		nested := orm.GOrmDB("ormtest").Begin()
+		if err := nested.Create(&gOrmBean{A: "committed"}).Error; err != nil {
+			t.Fatal(err)
+		}
+		if err := nested.Commit().Error; err != nil {
+			t.Fatal(err)
+		}
+		nested = orm.GOrmDB("ormtest").Begin()
+		if err := nested.Create(&gOrmBean{A: "rolled back"}).Error; err != nil {
+			t.Fatal(err)
+		}
+		if err := nested.Rollback().Error; err != nil {
+			t.Fatal(err)
+		}
+		if err := orm.GOrmDB("ormtest").Model(&gOrmBean{}).Count(&count).Error; err != nil || count != 2 {
+			t.Fatalf("count after nested transactions %d %v", count, err)
+		}
+	})
+	var count int
+	if err := orm.GOrmDB("ormtest").Model(&gOrmBean{}).Count(&count).Error; err != nil || count != 0 {
+		t.Fatalf("count after rollback %d %v", count, err)
+	}
+	if orm.GOrmDB("ormtest") != db {
+		t.Fatal("gorm db not restored")
+	}
+}
+
+func TestXOrmTx(t *testing.T) {
+	engine := XOrm(t, "ormtest", []interface{}{&xOrmBean{}})
+	t.Run("tx", func(t *testing.T) {
+		XOrmTx(t, "ormtest")
+		xOrmBeanInserted = 0
+		session := orm.XOrmSession("ormtest")
+		if err := session.Begin(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := session.Insert(&xOrmBean{A: "a"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := session.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		session.Close()
+		other := orm.XOrmSession("ormtest")
+		defer other.Close()
+		if n, err := other.Count(&xOrmBean{}); err != nil || n != 1 {
+			t.Fatalf("count in tx %d %v", n, err)
+		}
+
+		if err := other.Begin(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := other.Insert(&xOrmBean{A: "rolled back"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := other.Rollback(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := orm.XOrmEngine("ormtest").Insert(&xOrmBean{A: "engine"}); err != nil {
+			t.Fatal(err)
+		}
+		if n, err := orm.XOrmEngine("ormtest").Count(&xOrmBean{}); err != nil || n != 2 {
+			t.Fatalf("count through the engine in tx %d %v", n, err)
+		}
+		if xOrmBeanInserted != 2 { // 回滚的插入不调用
+			t.Fatalf("AfterInsert called %d times, want 2", xOrmBeanInserted)
+		}
+	})
+	if n, err := engine.Count(&xOrmBean{}); err != nil || n != 0 {
+		t.Fatalf("count after rollback %d %v", n, err)
+	}
+}
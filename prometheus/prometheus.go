@@ -0,0 +1,76 @@
+// Package prometheus 将xorm redis cache的指标导出到Prometheus, 通过orm.XOrmRedisCacheSink使用
+// 单独成包, 不使用Prometheus时orm不需要依赖client_golang
+package prometheus
+
+import (
+	"time"
+
+	"github.com/marcosxz/orm"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type xOrmCacheSink struct {
+	events  *prometheus.CounterVec
+	bytes   *prometheus.HistogramVec
+	latency *prometheus.HistogramVec
+	ratio   *prometheus.HistogramVec
+}
+
+// NewXOrmCacheSink 创建Prometheus指标接收者并注册到registerer, registerer为nil时使用prometheus.DefaultRegisterer
+// 指标为 {namespace}_xorm_cache_events_total, {namespace}_xorm_cache_value_bytes, {namespace}_xorm_cache_latency_seconds, {namespace}_xorm_cache_compression_ratio
+func NewXOrmCacheSink(namespace string, registerer prometheus.Registerer) (orm.XOrmCacheSink, error) {
+	if registerer == nil {
+		registerer = prometheus.DefaultRegisterer
+	}
+	sink := &xOrmCacheSink{
+		events: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "xorm_cache",
+			Name:      "events_total",
+			Help:      "Number of xorm redis cache hits, misses, puts, deletes and errors.",
+		}, []string{"table", "event"}),
+		bytes: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "xorm_cache",
+			Name:      "value_bytes",
+			Help:      "Size of values read from or written to redis.",
+			Buckets:   prometheus.ExponentialBuckets(64, 4, 8),
+		}, []string{"table", "direction"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "xorm_cache",
+			Name:      "latency_seconds",
+			Help:      "Latency of xorm redis cache operations.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 2, 14),
+		}, []string{"table", "op"}),
+		ratio: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "xorm_cache",
+			Name:      "compression_ratio",
+			Help:      "Compressed size divided by raw size of compressed values.",
+			Buckets:   prometheus.LinearBuckets(0.1, 0.1, 10),
+		}, []string{"table"}),
+	}
+	for _, collector := range []prometheus.Collector{sink.events, sink.bytes, sink.latency, sink.ratio} {
+		if err := registerer.Register(collector); err != nil {
+			return nil, err
+		}
+	}
+	return sink, nil
+}
+
+func (s *xOrmCacheSink) Count(table, event string) {
+	s.events.WithLabelValues(table, event).Inc()
+}
+
+func (s *xOrmCacheSink) Bytes(table, direction string, n int) {
+	s.bytes.WithLabelValues(table, direction).Observe(float64(n))
+}
+
+func (s *xOrmCacheSink) Latency(table, op string, d time.Duration) {
+	s.latency.WithLabelValues(table, op).Observe(d.Seconds())
+}
+
+func (s *xOrmCacheSink) Compression(table string, raw, compressed int) {
+	s.ratio.WithLabelValues(table).Observe(float64(compressed) / float64(raw))
+}
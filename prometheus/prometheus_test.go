@@ -0,0 +1,42 @@
+package prometheus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/marcosxz/orm"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestNewXOrmCacheSink(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	sink, err := NewXOrmCacheSink("test", registry)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if _, err := NewXOrmCacheSink("test", registry); err == nil {
+		t.Error("duplicate registration without error")
+		t.FailNow()
+	}
+	sink.Count("user", orm.XOrmCacheHit)
+	sink.Bytes("user", "read", 100)
+	sink.Latency("user", "GetBean", time.Millisecond)
+	sink.Compression("user", 100, 40)
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	names := make(map[string]bool)
+	for _, family := range families {
+		names[family.GetName()] = true
+	}
+	for _, name := range []string{"test_xorm_cache_events_total", "test_xorm_cache_value_bytes", "test_xorm_cache_latency_seconds", "test_xorm_cache_compression_ratio"} {
+		if !names[name] {
+			t.Errorf("metric %s not gathered", name)
+			t.FailNow()
+		}
+	}
+}
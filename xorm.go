@@ -270,10 +270,10 @@ func setXOrmEngineOptions(engine *xorm.Engine, opts *xOrmOption) error {
 		engine.SetMapper(opts.mapper)
 	}
 	if opts.tableMapper != nil {
-		engine.SetTableMapper(opts.mapper)
+		engine.SetTableMapper(opts.tableMapper)
 	}
 	if opts.columnMapper != nil {
-		engine.SetColumnMapper(opts.mapper)
+		engine.SetColumnMapper(opts.columnMapper)
 	}
 	engine.SetDisableGlobalCache(opts.disableGlobalCache)
 	engine.ShowExecTime(opts.showExecTime)
@@ -282,6 +282,8 @@ func setXOrmEngineOptions(engine *xorm.Engine, opts *xOrmOption) error {
 	if opts.noAutoTime {
 		engine.NoAutoTime()
 	}
+	XOrmRegisterCacheType(opts.sync...)
+	XOrmRegisterCacheType(opts.sync2...)
 	if len(opts.sync) > 0 {
 		if err := engine.Sync(opts.sync...); err != nil {
 			return err
@@ -296,10 +298,44 @@ func setXOrmEngineOptions(engine *xorm.Engine, opts *xOrmOption) error {
 }
 
 func xOrmRegister(name string, engine *xorm.Engine) {
+	old, loaded := xOrmEngine.Load(name)
 	xOrmEngine.Store(name, engine)
+	if loaded && old != nil && old != engine { // 重复初始化时排空并释放旧的连接池
+		o := old.(*xorm.Engine)
+		if xOrmEngineInUse(o) { // 仍被其他名称或分组使用, 由最后的使用者关闭
+			return
+		}
+		drainClose("xorm engine '"+name+"'", o.Close, o.DB().DB)
+	}
+}
+
+// CloseXOrmEngine 关闭并注销指定名称的xorm engine
+// engine仍以其他名称注册或属于已注册的分组时只注销, 由CloseXOrmEngineGroup关闭
+func CloseXOrmEngine(name string) error {
+	if engine, ok := xOrmEngine.Load(name); ok && engine != nil {
+		xOrmEngine.Delete(name)
+		if xOrmEngineInUse(engine.(*xorm.Engine)) {
+			return nil
+		}
+		return engine.(*xorm.Engine).Close()
+	}
+	return nil
+}
+
+// 判断engine是否以某个名称注册在xOrmEngine中
+func xOrmEngineRegistered(engine *xorm.Engine) (registered bool) {
+	xOrmEngine.Range(func(key, value interface{}) bool {
+		registered = value == engine
+		return !registered
+	})
+	return
 }
 
+// XOrmEngine 返回name的xorm engine, 通过XOrmBindTx绑定了事务时返回运行在该事务中的engine
 func XOrmEngine(name string) *xorm.Engine {
+	if engine, ok := xOrmTxs.Load(name); ok {
+		return engine.(*xorm.Engine)
+	}
 	if engine, ok := xOrmEngine.Load(name); ok && engine != nil {
 		return engine.(*xorm.Engine)
 	}
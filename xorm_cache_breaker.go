@@ -0,0 +1,256 @@
+package orm
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// redis返回的错误(包括redis.Nil)说明连接正常, 不计入熔断
+var xOrmRedisErrorType = reflect.TypeOf(redis.Nil)
+
+// 熔断期间每张表记录的ids或bean删除数量, 超过后改为恢复时清除整张表
+const xOrmCachePendingLimit = 1000
+
+// 连接错误或超时, redis返回的错误不算
+func xOrmRedisConnError(err error) bool {
+	return err != nil && reflect.TypeOf(err) != xOrmRedisErrorType
+}
+
+// 每次缓存操作(GetBean, PutIds, ClearBeans等, 可能包含多个redis命令)的超时时间, 超时视为未命中或写入失败
+// NewXOrmRedisCache创建的连接同时使用该值作为连接, 读, 写以及等待连接池的超时时间, 默认使用go-redis的默认值
+func XOrmRedisCacheTimeout(timeout time.Duration) XOrmRedisCacheOption {
+	return func(options *xOrmRedisCacheOption) {
+		options.timeout = timeout
+	}
+}
+
+// 连续failures次连接错误或超时后熔断, 熔断期间读取视为未命中, 写入直接忽略
+// 熔断期间以及因连接错误失败的删除按表记录下来, 恢复后在处理其他请求之前重放, 重放完成前读取视为未命中
+// 熔断cooldown后放行一个请求探测, 成功则恢复, 失败则继续熔断, 探测请求cooldown内没有访问redis时放行下一个请求探测
+// 熔断统计的是client副本上的命令, client需要是*redis.Client, *redis.ClusterClient或*redis.Ring
+func XOrmRedisCacheBreaker(failures int, cooldown time.Duration) XOrmRedisCacheOption {
+	return func(options *xOrmRedisCacheOption) {
+		options.breakerFailures = failures
+		options.breakerCooldown = cooldown
+	}
+}
+
+type xOrmCacheBreaker struct {
+	addr      string
+	logger    XOrmCacheLogger
+	failures  int
+	cooldown  time.Duration
+	mu        sync.Mutex
+	failed    int
+	openUntil time.Time
+	probing   bool
+	probeEnd  time.Time // 探测请求可能没有发出redis命令(如key生成失败), 到期后重新放行探测
+}
+
+func newXOrmCacheBreaker(addr string, logger XOrmCacheLogger, failures int, cooldown time.Duration) *xOrmCacheBreaker {
+	if failures <= 0 {
+		return nil
+	}
+	return &xOrmCacheBreaker{addr: addr, logger: logger, failures: failures, cooldown: cooldown}
+}
+
+// 是否允许访问redis, 未开启熔断时始终允许
+func (b *xOrmCacheBreaker) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failed < b.failures {
+		return true
+	}
+	now := time.Now()
+	if (b.probing && now.Before(b.probeEnd)) || now.Before(b.openUntil) {
+		return false
+	}
+	b.probing, b.probeEnd = true, now.Add(b.cooldown)
+	return true
+}
+
+func (b *xOrmCacheBreaker) open() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failed >= b.failures
+}
+
+func (b *xOrmCacheBreaker) report(err error) {
+	if b == nil {
+		return
+	}
+	if !xOrmRedisConnError(err) {
+		err = nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		if b.failed >= b.failures {
+			b.logger.Printf("[INFO] xorm redis cache '%s' recovered", b.addr)
+		}
+		b.failed, b.probing = 0, false
+		return
+	}
+	b.failed++
+	if b.failed >= b.failures {
+		if b.failed == b.failures || b.probing {
+			b.logger.Printf("[ERROR] xorm redis cache '%s' circuit open for %s: %v", b.addr, b.cooldown, err)
+		}
+		b.openUntil, b.probing = time.Now().Add(b.cooldown), false
+	}
+}
+
+// 在client的副本上通过WrapProcess统计所有命令的结果, 副本与client共用连接池, 调用方的client不受影响
+func (b *xOrmCacheBreaker) wrap(client XOrmRedisClient) (XOrmRedisClient, error) {
+	if b == nil {
+		return client, nil
+	}
+	switch c := client.(type) {
+	case *redis.Client:
+		client = c.WithContext(c.Context())
+	case *redis.ClusterClient:
+		client = c.WithContext(c.Context())
+	case *redis.Ring:
+		client = c.WithContext(c.Context())
+	default:
+		return nil, fmt.Errorf("xorm redis cache breaker does not support %T", client)
+	}
+	client.WrapProcess(func(process func(cmd redis.Cmder) error) func(cmd redis.Cmder) error {
+		return func(cmd redis.Cmder) error {
+			err := process(cmd)
+			b.report(err)
+			return err
+		}
+	})
+	client.WrapProcessPipeline(func(process func(cmds []redis.Cmder) error) func(cmds []redis.Cmder) error {
+		return func(cmds []redis.Cmder) error {
+			err := process(cmds)
+			b.report(err)
+			return err
+		}
+	})
+	return client, nil
+}
+
+// 在超时时间内执行一次缓存操作, 返回false表示超时
+// go-redis v6的命令不接受ctx, 超时后不再等待, 操作在后台继续直到连接的读写超时, 结果被丢弃
+func (c *xOrmRedisCache) withTimeout(tableName, op string, fn func() interface{}) (interface{}, bool) {
+	if c.timeout <= 0 {
+		return fn(), true
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	done := make(chan interface{}, 1)
+	go func() { done <- fn() }()
+	select {
+	case value := <-done:
+		return value, true
+	case <-ctx.Done():
+		c.breaker.report(ctx.Err())
+		c.error(tableName, op, ctx.Err())
+		return nil, false
+	}
+}
+
+// 一张表没有执行的删除
+type xOrmCachePending struct {
+	ids, beans           map[string]struct{}
+	clearIds, clearBeans bool
+}
+
+// 是否可以访问redis, 先重放之前没有执行的删除, 重放失败时不能访问
+func (c *xOrmRedisCache) available() bool {
+	return c.breaker.allow() && c.replay() == nil
+}
+
+func (c *xOrmRedisCache) addPending(tableName, op, arg string) {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	p, ok := c.pending[tableName]
+	if !ok {
+		p = &xOrmCachePending{ids: map[string]struct{}{}, beans: map[string]struct{}{}}
+		c.pending[tableName] = p
+		atomic.AddInt32(&c.pendingTables, 1)
+	}
+	switch op {
+	case "DelIds":
+		if p.ids[arg] = struct{}{}; len(p.ids) > xOrmCachePendingLimit {
+			p.clearIds = true
+		}
+	case "DelBean":
+		if p.beans[arg] = struct{}{}; len(p.beans) > xOrmCachePendingLimit {
+			p.clearBeans = true
+		}
+	case "ClearIds":
+		p.clearIds = true
+	case "ClearBeans":
+		p.clearBeans = true
+	}
+	if p.clearIds {
+		p.ids = map[string]struct{}{}
+	}
+	if p.clearBeans {
+		p.beans = map[string]struct{}{}
+	}
+}
+
+// 重放记录的删除, 连接错误时保留剩余的删除, redis返回的错误只记录日志
+func (c *xOrmRedisCache) replay() error {
+	if atomic.LoadInt32(&c.pendingTables) == 0 {
+		return nil
+	}
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	del := func(tableName, op, arg string) error {
+		err := c.del(tableName, op, arg)
+		if err != nil {
+			c.error(tableName, op, err)
+		}
+		if xOrmRedisConnError(err) {
+			return err
+		}
+		return nil
+	}
+	for tableName, p := range c.pending {
+		if p.clearIds {
+			if err := del(tableName, "ClearIds", ""); err != nil {
+				return err
+			}
+			p.clearIds = false
+		}
+		if p.clearBeans {
+			if err := del(tableName, "ClearBeans", ""); err != nil {
+				return err
+			}
+			p.clearBeans = false
+		}
+		for sql := range p.ids {
+			if err := del(tableName, "DelIds", sql); err != nil {
+				return err
+			}
+			delete(p.ids, sql)
+		}
+		for id := range p.beans {
+			if err := del(tableName, "DelBean", id); err != nil {
+				return err
+			}
+			delete(p.beans, id)
+		}
+		delete(c.pending, tableName)
+		atomic.AddInt32(&c.pendingTables, -1)
+		c.logger.Printf("[INFO] xorm redis cache '%s' replayed pending invalidations of %s", c.addr, tableName)
+	}
+	return nil
+}
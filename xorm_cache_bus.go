@@ -0,0 +1,268 @@
+package orm
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"xorm.io/core"
+)
+
+// XOrmCacheBusChannel 默认的缓存失效通知channel
+const XOrmCacheBusChannel = "xorm:cache:invalidate"
+
+const (
+	xOrmBusDelBean = iota
+	xOrmBusDelIds
+	xOrmBusClearBeans
+	xOrmBusClearIds
+	xOrmBusFlush
+)
+
+// 连接空闲时的ping间隔以及断线后的重试间隔
+const (
+	xOrmBusPingInterval = time.Second * 30
+	xOrmBusRetryBackoff = time.Second
+)
+
+var xOrmCacheBuses sync.Map // make(map[*xOrmCacheBus]struct{})
+
+type xOrmBusMessage struct {
+	Instance string `json:"i"`
+	Op       int    `json:"o"`
+	Table    string `json:"t,omitempty"`
+	Key      string `json:"k,omitempty"` // bean为id, ids为sql
+}
+
+type xOrmCacheBus struct {
+	id        string
+	channel   string
+	client    XOrmRedisClient
+	logger    XOrmCacheLogger
+	pubsub    *redis.PubSub
+	mu        sync.RWMutex
+	cachers   []core.Cacher
+	tables    map[string]struct{} // Cacher写入过以及收发过失效通知的表, 全量清除时使用
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewXOrmCacheBus 在cache的redis连接上创建缓存失效通知总线, channel为空时使用XOrmCacheBusChannel, 设置了namespace时加上namespace前缀
+// 通过Cacher包装的cacher在DelBean/DelIds/ClearBeans/ClearIds时向其他进程发布通知
+// 收到其他进程的通知时清除所有Cacher/Attach的进程内缓存, 断线期间可能丢失通知, 重连后会清空全部进程内缓存
+func NewXOrmCacheBus(cache *xOrmRedisCache, channel string) *xOrmCacheBus {
+	if channel == "" {
+		channel = cache.prefix(XOrmCacheBusChannel)
+	}
+	bus := &xOrmCacheBus{
+		id:      xOrmBusInstanceID(),
+		channel: channel,
+		client:  cache.client,
+		logger:  cache.logger,
+		tables:  make(map[string]struct{}),
+		done:    make(chan struct{}),
+	}
+	bus.pubsub = bus.client.Subscribe(channel)
+	go bus.receive()
+	xOrmCacheBuses.Store(bus, struct{}{})
+	return bus
+}
+
+// Cacher 包装cacher, 失效操作在执行后通知其他进程, 同时接收其他进程的通知
+func (b *xOrmCacheBus) Cacher(cacher core.Cacher) core.Cacher {
+	b.Attach(cacher)
+	return &xOrmBusCacher{Cacher: cacher, bus: b}
+}
+
+// Attach 只接收通知, 用于xorm的LRUCacher等不需要对外发布的进程内cacher
+// NewXOrmTwoTierCache只清除进程内一层, NewXOrmRedisCache会被忽略
+// 重连后的全量清除只能清除总线已知的表, 使用Cacher包装的cacher会记录写入的表
+func (b *xOrmCacheBus) Attach(cachers ...core.Cacher) {
+	b.mu.Lock()
+	b.cachers = append(b.cachers, cachers...)
+	b.mu.Unlock()
+}
+
+// Close 取消订阅, 不会关闭cache的redis连接
+func (b *xOrmCacheBus) Close() error {
+	var err error
+	b.closeOnce.Do(func() {
+		close(b.done)
+		xOrmCacheBuses.Delete(b)
+		err = b.pubsub.Close()
+	})
+	return err
+}
+
+func (b *xOrmCacheBus) publish(op int, tableName, key string) {
+	b.addTable(tableName)
+	bs, err := json.Marshal(&xOrmBusMessage{Instance: b.id, Op: op, Table: tableName, Key: key})
+	if err == nil {
+		err = b.client.Publish(b.channel, bs).Err()
+	}
+	if err != nil {
+		b.logger.Printf("[ERROR] xorm cache bus publish to '%s' error: %v", b.channel, err)
+	}
+}
+
+func (b *xOrmCacheBus) addTable(tableName string) {
+	b.mu.RLock()
+	_, ok := b.tables[tableName]
+	b.mu.RUnlock()
+	if !ok {
+		b.mu.Lock()
+		b.tables[tableName] = struct{}{}
+		b.mu.Unlock()
+	}
+}
+
+func (b *xOrmCacheBus) receive() {
+	missed := false // 断线期间的通知已丢失, 重新订阅成功后需要全量清除
+	for {
+		msg, err := b.pubsub.ReceiveTimeout(xOrmBusPingInterval)
+		select {
+		case <-b.done:
+			return
+		default:
+		}
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				err = b.pubsub.Ping() // 空闲超时, ping失败时pubsub会在下次Receive时重连并重新订阅
+			}
+			if err != nil {
+				if !missed {
+					b.logger.Printf("[ERROR] xorm cache bus receive from '%s' error: %v", b.channel, err)
+				}
+				missed = true
+				select {
+				case <-b.done:
+					return
+				case <-time.After(xOrmBusRetryBackoff):
+				}
+			}
+			continue
+		}
+		switch msg := msg.(type) {
+		case *redis.Subscription:
+			if missed && msg.Kind == "subscribe" {
+				b.logger.Printf("[INFO] xorm cache bus resubscribed to '%s', flush local caches", b.channel)
+				b.apply(&xOrmBusMessage{Op: xOrmBusFlush})
+				missed = false
+			}
+		case *redis.Message:
+			var m xOrmBusMessage
+			if err := json.Unmarshal([]byte(msg.Payload), &m); err != nil {
+				b.logger.Printf("[ERROR] xorm cache bus invalid message '%s': %v", msg.Payload, err)
+				continue
+			}
+			if m.Instance != b.id {
+				b.apply(&m)
+			}
+		}
+	}
+}
+
+// 对所有进程内cacher执行失效操作
+func (b *xOrmCacheBus) apply(m *xOrmBusMessage) {
+	if m.Op != xOrmBusFlush {
+		b.addTable(m.Table)
+	}
+	b.mu.RLock()
+	cachers := b.cachers
+	tables := make([]string, 0, len(b.tables))
+	for table := range b.tables {
+		tables = append(tables, table)
+	}
+	b.mu.RUnlock()
+	for _, cacher := range cachers {
+		switch c := cacher.(type) {
+		case *xOrmRedisCache: // 已由发布方清除
+		case *xOrmTwoTierCache:
+			c.local.apply(m)
+		default:
+			xOrmBusApply(c, m, tables)
+		}
+	}
+}
+
+func (c *xOrmLocalCache) apply(m *xOrmBusMessage) {
+	switch m.Op {
+	case xOrmBusDelBean:
+		c.del(xOrmLocalKey{kind: xOrmLocalBean, table: m.Table, key: m.Key})
+	case xOrmBusDelIds:
+		c.del(xOrmLocalKey{kind: xOrmLocalIds, table: m.Table, key: m.Key})
+	case xOrmBusClearBeans:
+		c.clear(xOrmLocalBean, m.Table)
+	case xOrmBusClearIds:
+		c.clear(xOrmLocalIds, m.Table)
+	case xOrmBusFlush:
+		c.flush()
+	}
+}
+
+// core.Cacher没有清空所有表的方法, 全量清除时只能清除已知的表(xOrmBusCacher写入过以及收发过通知的表)
+func xOrmBusApply(cacher core.Cacher, m *xOrmBusMessage, tables []string) {
+	switch m.Op {
+	case xOrmBusDelBean:
+		cacher.DelBean(m.Table, m.Key)
+	case xOrmBusDelIds:
+		cacher.DelIds(m.Table, m.Key)
+	case xOrmBusClearBeans:
+		cacher.ClearBeans(m.Table)
+	case xOrmBusClearIds:
+		cacher.ClearIds(m.Table)
+	case xOrmBusFlush:
+		for _, table := range tables {
+			cacher.ClearBeans(table)
+			cacher.ClearIds(table)
+		}
+	}
+}
+
+func xOrmBusInstanceID() string {
+	bs := make([]byte, 8)
+	_, _ = rand.Read(bs)
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(bs))
+}
+
+type xOrmBusCacher struct {
+	core.Cacher
+	bus *xOrmCacheBus
+}
+
+func (c *xOrmBusCacher) PutIds(tableName, sql string, ids interface{}) {
+	c.bus.addTable(tableName)
+	c.Cacher.PutIds(tableName, sql, ids)
+}
+
+func (c *xOrmBusCacher) PutBean(tableName string, id string, obj interface{}) {
+	c.bus.addTable(tableName)
+	c.Cacher.PutBean(tableName, id, obj)
+}
+
+func (c *xOrmBusCacher) DelIds(tableName, sql string) {
+	c.Cacher.DelIds(tableName, sql)
+	c.bus.publish(xOrmBusDelIds, tableName, sql)
+}
+
+func (c *xOrmBusCacher) DelBean(tableName string, id string) {
+	c.Cacher.DelBean(tableName, id)
+	c.bus.publish(xOrmBusDelBean, tableName, id)
+}
+
+func (c *xOrmBusCacher) ClearIds(tableName string) {
+	c.Cacher.ClearIds(tableName)
+	c.bus.publish(xOrmBusClearIds, tableName, "")
+}
+
+func (c *xOrmBusCacher) ClearBeans(tableName string) {
+	c.Cacher.ClearBeans(tableName)
+	c.bus.publish(xOrmBusClearBeans, tableName, "")
+}
@@ -0,0 +1,108 @@
+package orm
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis"
+)
+
+// 每次SCAN的数量以及每个pipeline中UNLINK的key数量
+const xOrmCacheClearBatch = 1000
+
+// 开启后key中包含表的代数, ClearBeans/ClearIds只需要将代数加1, 旧的缓存等待过期
+// 每次读写会多一次读取代数的请求, 需要设置过期时间, 否则旧的缓存不会被删除
+func XOrmRedisCacheGenerations(generations bool) XOrmRedisCacheOption {
+	return func(options *xOrmRedisCacheOption) {
+		options.generations = generations
+	}
+}
+
+func (c *xOrmRedisCache) generationKey(kind, tableName string) string {
+	return c.prefix("xorm:generation:" + kind + ":" + tableName)
+}
+
+// 开启分代时在key后加上表的当前代数
+func (c *xOrmRedisCache) withGeneration(kind, tableName, key string) (string, error) {
+	if !c.generations {
+		return key, nil
+	}
+	generation, err := c.client.Get(c.generationKey(kind, tableName)).Int64()
+	if err != nil && err != redis.Nil {
+		return "", err
+	}
+	return key + ":g" + strconv.FormatInt(generation, 10), nil
+}
+
+func (c *xOrmRedisCache) beanKeyOf(tableName, id string) (string, error) {
+	return c.withGeneration("bean", tableName, c.beanKey(tableName, id))
+}
+
+func (c *xOrmRedisCache) sqlKeyOf(tableName, sql string) (string, error) {
+	return c.withGeneration("sql", tableName, c.sqlKey(tableName, sql))
+}
+
+// 清除表的所有bean或id列表
+func (c *xOrmRedisCache) clear(kind, tableName, pattern string) error {
+	if c.generations {
+		return c.client.Incr(c.generationKey(kind, tableName)).Err()
+	}
+	return c.delAll(pattern)
+}
+
+// 分批SCAN匹配的key并通过pipeline UNLINK, 集群模式下扫描每个master
+func (c *xOrmRedisCache) delAll(pattern string) error {
+	if cluster, ok := c.client.(*redis.ClusterClient); ok {
+		return cluster.ForEachMaster(func(client *redis.Client) error {
+			return xOrmCacheScanUnlink(client, pattern)
+		})
+	}
+	return xOrmCacheScanUnlink(c.client, pattern)
+}
+
+func xOrmCacheScanUnlink(client redis.Cmdable, pattern string) error {
+	var cursor uint64
+	for {
+		keys, next, err := client.Scan(cursor, pattern, xOrmCacheClearBatch).Result()
+		if err == redis.Nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := xOrmCacheUnlink(client, keys); err != nil {
+			return err
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// 每个key单独UNLINK, 避免集群模式下的CROSSSLOT错误, redis 4.0以下使用DEL
+func xOrmCacheUnlink(client redis.Cmdable, keys []string) error {
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > xOrmCacheClearBatch {
+			n = xOrmCacheClearBatch
+		}
+		pipe := client.Pipeline()
+		for _, key := range keys[:n] {
+			pipe.Unlink(key)
+		}
+		_, err := pipe.Exec()
+		if err != nil && strings.Contains(strings.ToLower(err.Error()), "unknown command") {
+			pipe = client.Pipeline()
+			for _, key := range keys[:n] {
+				pipe.Del(key)
+			}
+			_, err = pipe.Exec()
+		}
+		if err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
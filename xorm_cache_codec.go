@@ -0,0 +1,142 @@
+package orm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sync"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+// XOrmCacheCodec xOrmRedisCache中bean与id列表的编码方式, 通过XOrmRedisCacheCodec设置
+// Unmarshal的v为指向值类型的指针, 值的类型名由cache写在payload中, 不需要gob.Register
+type XOrmCacheCodec interface {
+	Marshal(value interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	XOrmCacheGobCodec     XOrmCacheCodec = gobCodec{}
+	XOrmCacheJSONCodec    XOrmCacheCodec = jsonCodec{}
+	XOrmCacheMsgpackCodec XOrmCacheCodec = msgpackCodec{}
+)
+
+var (
+	errCodecUnknownType    = errors.New("unknown cache value type")
+	errCodecInvalidPayload = errors.New("invalid cache payload")
+)
+
+// 可以解码的类型, 类型名 => reflect.Type
+// 包括XOrmRegisterCacheType/XOrmSync/XOrmSync2注册的bean以及本进程编码过的类型, 读取到其他类型时视为未命中
+var codecTypes sync.Map
+
+func init() {
+	XOrmRegisterCacheType("", []byte(nil))
+}
+
+// XOrmRegisterCacheType 注册缓存中bean的类型, 新启动的进程不需要先写入一次就可以读取其他进程写入的缓存
+// XOrmSync/XOrmSync2的bean会自动注册, 传入结构体或结构体指针均会同时注册两种类型
+func XOrmRegisterCacheType(beans ...interface{}) {
+	for _, bean := range beans {
+		if bean == nil {
+			continue
+		}
+		t := reflect.TypeOf(bean)
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		for _, t := range []reflect.Type{t, reflect.PtrTo(t)} {
+			codecTypes.LoadOrStore(codecTypeName(t), t)
+		}
+	}
+}
+
+func codecTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return "*" + codecTypeName(t.Elem())
+	case reflect.Slice:
+		if t.Name() == "" {
+			return "[]" + codecTypeName(t.Elem())
+		}
+	}
+	if t.PkgPath() == "" {
+		return t.String()
+	}
+	return t.PkgPath() + "." + t.Name()
+}
+
+// 编码为 uvarint(len(类型名)) + 类型名 + codec编码的值
+func codecMarshal(codec XOrmCacheCodec, value interface{}) ([]byte, error) {
+	if value == nil {
+		return nil, errors.New("cache value is nil")
+	}
+	t := reflect.TypeOf(value)
+	name := codecTypeName(t)
+	codecTypes.LoadOrStore(name, t)
+	data, err := codec.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	buffer := bytes.NewBuffer(make([]byte, 0, binary.MaxVarintLen64+len(name)+len(data)))
+	var n [binary.MaxVarintLen64]byte
+	buffer.Write(n[:binary.PutUvarint(n[:], uint64(len(name)))])
+	buffer.WriteString(name)
+	buffer.Write(data)
+	return buffer.Bytes(), nil
+}
+
+func codecUnmarshal(codec XOrmCacheCodec, bs []byte) (interface{}, error) {
+	size, n := binary.Uvarint(bs)
+	if n <= 0 || uint64(len(bs)-n) < size {
+		return nil, errCodecInvalidPayload
+	}
+	name := string(bs[n : n+int(size)])
+	t, ok := codecTypes.Load(name)
+	if !ok {
+		return nil, errCodecUnknownType
+	}
+	ptr := reflect.New(t.(reflect.Type))
+	if err := codec.Unmarshal(bs[n+int(size):], ptr.Interface()); err != nil {
+		return nil, errCodecInvalidPayload
+	}
+	return ptr.Elem().Interface(), nil
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Marshal(value interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(value); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(value interface{}) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Marshal(value interface{}) ([]byte, error) {
+	return msgpack.Marshal(value)
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
@@ -0,0 +1,122 @@
+package orm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// XOrmCacheCompression xOrmRedisCache的压缩算法, 值为写入header中的算法标识, 不能修改
+type XOrmCacheCompression byte
+
+const (
+	XOrmCacheNoCompression XOrmCacheCompression = iota
+	XOrmCacheSnappy
+	XOrmCacheZstd
+	XOrmCacheGzip
+)
+
+// 压缩后的值为 0 + 算法标识 + 压缩的数据
+// codec编码的值以非空类型名的长度开头, 不会以0开头, 因此未压缩的旧值仍然可以读取
+const xOrmCacheCompressedMark = 0
+
+var (
+	xOrmZstdOnce    sync.Once
+	xOrmZstdEncoder *zstd.Encoder
+	xOrmZstdDecoder *zstd.Decoder
+	xOrmZstdErr     error
+)
+
+// 开启压缩, codec编码后不小于threshold字节的值才会压缩, 压缩后没有变小时保存原值
+// 读取时根据header解压, 与算法以及是否开启压缩无关
+func XOrmRedisCacheCompression(compression XOrmCacheCompression, threshold int) XOrmRedisCacheOption {
+	return func(options *xOrmRedisCacheOption) {
+		options.compression = compression
+		options.compressThreshold = threshold
+	}
+}
+
+func (c XOrmCacheCompression) String() string {
+	switch c {
+	case XOrmCacheNoCompression:
+		return "none"
+	case XOrmCacheSnappy:
+		return "snappy"
+	case XOrmCacheZstd:
+		return "zstd"
+	case XOrmCacheGzip:
+		return "gzip"
+	}
+	return fmt.Sprintf("compression(%d)", byte(c))
+}
+
+func xOrmZstd() (*zstd.Encoder, *zstd.Decoder, error) {
+	xOrmZstdOnce.Do(func() {
+		if xOrmZstdEncoder, xOrmZstdErr = zstd.NewWriter(nil); xOrmZstdErr != nil {
+			return
+		}
+		xOrmZstdDecoder, xOrmZstdErr = zstd.NewReader(nil)
+	})
+	return xOrmZstdEncoder, xOrmZstdDecoder, xOrmZstdErr
+}
+
+func xOrmCacheCompress(compression XOrmCacheCompression, data []byte) ([]byte, error) {
+	dst := []byte{xOrmCacheCompressedMark, byte(compression)}
+	switch compression {
+	case XOrmCacheSnappy:
+		return append(dst, snappy.Encode(nil, data)...), nil
+	case XOrmCacheZstd:
+		encoder, _, err := xOrmZstd()
+		if err != nil {
+			return nil, err
+		}
+		return encoder.EncodeAll(data, dst), nil
+	case XOrmCacheGzip:
+		buffer := bytes.NewBuffer(dst)
+		writer := gzip.NewWriter(buffer)
+		if _, err := writer.Write(data); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		return buffer.Bytes(), nil
+	}
+	return nil, fmt.Errorf("not support cache compression:%s", compression)
+}
+
+// 没有压缩header时原样返回
+func xOrmCacheDecompress(bs []byte) ([]byte, error) {
+	if len(bs) == 0 || bs[0] != xOrmCacheCompressedMark {
+		return bs, nil
+	}
+	if len(bs) < 2 {
+		return nil, errors.New("invalid cache payload")
+	}
+	data := bs[2:]
+	switch compression := XOrmCacheCompression(bs[1]); compression {
+	case XOrmCacheSnappy:
+		return snappy.Decode(nil, data)
+	case XOrmCacheZstd:
+		_, decoder, err := xOrmZstd()
+		if err != nil {
+			return nil, err
+		}
+		return decoder.DecodeAll(data, nil)
+	case XOrmCacheGzip:
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return ioutil.ReadAll(reader)
+	default:
+		return nil, fmt.Errorf("not support cache compression:%s", compression)
+	}
+}
@@ -0,0 +1,204 @@
+package orm
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// xOrmRedisCache的事件
+const (
+	XOrmCacheHit    = "hit"
+	XOrmCacheMiss   = "miss"
+	XOrmCachePut    = "put"
+	XOrmCacheDelete = "delete"
+	XOrmCacheError  = "error"
+)
+
+// XOrmCacheLogger xOrmRedisCache的日志, *log.Logger满足该接口
+type XOrmCacheLogger interface {
+	Printf(format string, v ...interface{})
+}
+
+// XOrmCacheSink 接收xOrmRedisCache的指标, 实现需要是并发安全的
+type XOrmCacheSink interface {
+	// event为XOrmCacheHit, XOrmCacheMiss, XOrmCachePut, XOrmCacheDelete或XOrmCacheError
+	Count(table, event string)
+	// 写入(write)或读取(read)redis的值的字节数
+	Bytes(table, direction string, n int)
+	// op为GetIds, GetBean, PutIds, PutBean, DelIds, DelBean, ClearIds, ClearBeans
+	Latency(table, op string, d time.Duration)
+	// 压缩前后的字节数
+	Compression(table string, raw, compressed int)
+}
+
+// XOrmCacheTableStats 一张表的缓存统计
+type XOrmCacheTableStats struct {
+	Hits         int64
+	Misses       int64
+	Puts         int64
+	Deletes      int64
+	Errors       int64
+	BytesRead    int64
+	BytesWritten int64
+	Compressed   int64         // 压缩的值的个数
+	RawBytes     int64         // 压缩前的字节数
+	ZippedBytes  int64         // 压缩后的字节数
+	Ops          int64         // 操作次数
+	Latency      time.Duration // 所有操作的总耗时
+	MaxLatency   time.Duration
+}
+
+// HitRate 命中率, 没有读取时为0
+func (s XOrmCacheTableStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// CompressionRatio 压缩后与压缩前的字节数之比, 没有压缩时为0
+func (s XOrmCacheTableStats) CompressionRatio() float64 {
+	if s.RawBytes == 0 {
+		return 0
+	}
+	return float64(s.ZippedBytes) / float64(s.RawBytes)
+}
+
+// 默认使用log.Printf
+func XOrmRedisCacheLogger(logger XOrmCacheLogger) XOrmRedisCacheOption {
+	return func(options *xOrmRedisCacheOption) {
+		options.logger = logger
+	}
+}
+
+// 增加指标接收者, 可以设置多个
+func XOrmRedisCacheSink(sink XOrmCacheSink) XOrmRedisCacheOption {
+	return func(options *xOrmRedisCacheOption) {
+		options.sinks = append(options.sinks, sink)
+	}
+}
+
+type xOrmStdLogger struct{}
+
+func (xOrmStdLogger) Printf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+}
+
+type xOrmCacheMetrics struct {
+	sinks  []XOrmCacheSink
+	mu     sync.Mutex
+	tables map[string]*XOrmCacheTableStats
+}
+
+func newXOrmCacheMetrics(sinks []XOrmCacheSink) *xOrmCacheMetrics {
+	return &xOrmCacheMetrics{sinks: sinks, tables: make(map[string]*XOrmCacheTableStats)}
+}
+
+// 调用方持有锁
+func (m *xOrmCacheMetrics) table(table string) *XOrmCacheTableStats {
+	stats, ok := m.tables[table]
+	if !ok {
+		stats = new(XOrmCacheTableStats)
+		m.tables[table] = stats
+	}
+	return stats
+}
+
+// 直接构造的cache没有metrics, 租户表按原表统计
+func (m *xOrmCacheMetrics) count(table, event string) {
+	if m == nil {
+		return
+	}
+	table = xOrmCacheBaseTable(table)
+	m.mu.Lock()
+	stats := m.table(table)
+	switch event {
+	case XOrmCacheHit:
+		stats.Hits++
+	case XOrmCacheMiss:
+		stats.Misses++
+	case XOrmCachePut:
+		stats.Puts++
+	case XOrmCacheDelete:
+		stats.Deletes++
+	case XOrmCacheError:
+		stats.Errors++
+	}
+	m.mu.Unlock()
+	for _, sink := range m.sinks {
+		sink.Count(table, event)
+	}
+}
+
+func (m *xOrmCacheMetrics) bytes(table, direction string, n int) {
+	if m == nil {
+		return
+	}
+	table = xOrmCacheBaseTable(table)
+	m.mu.Lock()
+	if direction == "read" {
+		m.table(table).BytesRead += int64(n)
+	} else {
+		m.table(table).BytesWritten += int64(n)
+	}
+	m.mu.Unlock()
+	for _, sink := range m.sinks {
+		sink.Bytes(table, direction, n)
+	}
+}
+
+func (m *xOrmCacheMetrics) compress(table string, raw, compressed int) {
+	if m == nil {
+		return
+	}
+	table = xOrmCacheBaseTable(table)
+	m.mu.Lock()
+	stats := m.table(table)
+	stats.Compressed++
+	stats.RawBytes += int64(raw)
+	stats.ZippedBytes += int64(compressed)
+	m.mu.Unlock()
+	for _, sink := range m.sinks {
+		sink.Compression(table, raw, compressed)
+	}
+}
+
+func (m *xOrmCacheMetrics) latency(table, op string, start time.Time) {
+	if m == nil {
+		return
+	}
+	table = xOrmCacheBaseTable(table)
+	d := time.Since(start)
+	m.mu.Lock()
+	stats := m.table(table)
+	stats.Ops++
+	stats.Latency += d
+	if d > stats.MaxLatency {
+		stats.MaxLatency = d
+	}
+	m.mu.Unlock()
+	for _, sink := range m.sinks {
+		sink.Latency(table, op, d)
+	}
+}
+
+// Stats 返回每张表的缓存统计快照, 所有租户合并统计
+func (c *xOrmRedisCache) Stats() map[string]XOrmCacheTableStats {
+	if c.metrics == nil {
+		return nil
+	}
+	c.metrics.mu.Lock()
+	defer c.metrics.mu.Unlock()
+	stats := make(map[string]XOrmCacheTableStats, len(c.metrics.tables))
+	for table, s := range c.metrics.tables {
+		stats[table] = *s
+	}
+	return stats
+}
+
+// 记录错误并输出日志
+func (c *xOrmRedisCache) error(table, op string, err error) {
+	c.metrics.count(table, XOrmCacheError)
+	c.logger.Printf("[ERROR] Xorm Redis Cacher <%s> Error:%s \n", op, err.Error())
+}
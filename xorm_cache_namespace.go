@@ -0,0 +1,83 @@
+package orm
+
+import (
+	"strings"
+
+	"xorm.io/core"
+)
+
+// 租户表名的分隔符, 租户的key为 xorm:bean:{table}@{tenant}:..., 清除表时不会匹配到其他租户
+const xOrmCacheTenantSep = "@"
+
+// 所有key以及默认的失效通知channel前加上 namespace + ":", 用于多个服务或环境共用同一个redis库
+func XOrmRedisCacheNamespace(namespace string) XOrmRedisCacheOption {
+	return func(options *xOrmRedisCacheOption) {
+		options.namespace = namespace
+	}
+}
+
+// XOrmCacheTenant 返回只读写tenant缓存的cacher, tenant为空时返回cacher本身
+// xorm的cacher不接收ctx, 无法按请求区分租户, 每个租户使用各自的engine,
+// 通过XOrmDefaultCache或XOrmCache设置返回的cacher, 多个租户可以共用同一个cacher
+func XOrmCacheTenant(cacher core.Cacher, tenant string) core.Cacher {
+	if tenant == "" {
+		return cacher
+	}
+	return &xOrmTenantCacher{cacher: cacher, tenant: tenant}
+}
+
+// 去掉租户, 用于查找表的过期时间, 布隆过滤器以及指标的表名
+func xOrmCacheBaseTable(tableName string) string {
+	if i := strings.LastIndex(tableName, xOrmCacheTenantSep); i >= 0 {
+		return tableName[:i]
+	}
+	return tableName
+}
+
+func (c *xOrmRedisCache) prefix(key string) string {
+	if c.namespace == "" {
+		return key
+	}
+	return c.namespace + ":" + key
+}
+
+type xOrmTenantCacher struct {
+	cacher core.Cacher
+	tenant string
+}
+
+func (c *xOrmTenantCacher) table(tableName string) string {
+	return tableName + xOrmCacheTenantSep + c.tenant
+}
+
+func (c *xOrmTenantCacher) GetIds(tableName, sql string) interface{} {
+	return c.cacher.GetIds(c.table(tableName), sql)
+}
+
+func (c *xOrmTenantCacher) GetBean(tableName string, id string) interface{} {
+	return c.cacher.GetBean(c.table(tableName), id)
+}
+
+func (c *xOrmTenantCacher) PutIds(tableName, sql string, ids interface{}) {
+	c.cacher.PutIds(c.table(tableName), sql, ids)
+}
+
+func (c *xOrmTenantCacher) PutBean(tableName string, id string, obj interface{}) {
+	c.cacher.PutBean(c.table(tableName), id, obj)
+}
+
+func (c *xOrmTenantCacher) DelIds(tableName, sql string) {
+	c.cacher.DelIds(c.table(tableName), sql)
+}
+
+func (c *xOrmTenantCacher) DelBean(tableName string, id string) {
+	c.cacher.DelBean(c.table(tableName), id)
+}
+
+func (c *xOrmTenantCacher) ClearIds(tableName string) {
+	c.cacher.ClearIds(c.table(tableName))
+}
+
+func (c *xOrmTenantCacher) ClearBeans(tableName string) {
+	c.cacher.ClearBeans(c.table(tableName))
+}
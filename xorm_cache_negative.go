@@ -0,0 +1,160 @@
+package orm
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"xorm.io/core"
+)
+
+// 查询结果为空时保存的值, codec编码的值不会以0开头
+var xOrmCacheNegativeSentinel = []byte("\x00xorm:not_found")
+
+// xorm通过core.PutCacheSql保存gob编码的[]core.PK, 命中sentinel时返回空的id列表
+var xOrmCacheEmptyIds = func() string {
+	var buffer bytes.Buffer
+	_ = gob.NewEncoder(&buffer).Encode([]core.PK{})
+	return buffer.String()
+}()
+
+// 开启后结果为空的id列表(Find等sql查询)以sentinel保存, 过期时间为ttl, 通常比正常的过期时间短
+// 写操作触发的DelBean/ClearBeans会清除该表所有的空结果, 插入触发的ClearIds会清除该表所有的id列表
+// xorm的Get查不到记录时不会调用cacher, 不存在的主键无法在bean层缓存, 需要通过XOrmRedisCacheBloomFilter防止穿透
+func XOrmRedisCacheNegative(ttl time.Duration) XOrmRedisCacheOption {
+	return func(options *xOrmRedisCacheOption) {
+		options.negativeTTL = ttl
+	}
+}
+
+// 为table开启主键布隆过滤器, n为预计的主键数量, p为误判率
+// PutBean会自动加入主键, 启动时可以通过BloomAdd加入已有的主键
+// GetBean时主键不在过滤器中直接视为未命中, 不访问redis; 按主键查询数据库前可以通过MayExist跳过一定不存在的主键
+func XOrmRedisCacheBloomFilter(table string, n uint, p float64) XOrmRedisCacheOption {
+	return func(options *xOrmRedisCacheOption) {
+		if options.blooms == nil {
+			options.blooms = make(map[string]*xOrmBloomFilter)
+		}
+		options.blooms[table] = newXOrmBloomFilter(n, p)
+	}
+}
+
+func xOrmCacheIsEmptyIds(value interface{}) bool {
+	s, ok := value.(string)
+	if !ok || len(s) > 64 {
+		return false
+	}
+	var ids []core.PK
+	return gob.NewDecoder(strings.NewReader(s)).Decode(&ids) == nil && len(ids) == 0
+}
+
+func (c *xOrmRedisCache) negativeKey(tableName string) string {
+	return c.prefix("xorm:negative:" + tableName)
+}
+
+// 记录table的空结果, 用于PutBean/DelBean时清除
+func (c *xOrmRedisCache) addNegative(tableName, key string) error {
+	pipe := c.client.TxPipeline()
+	pipe.SAdd(c.negativeKey(tableName), key)
+	pipe.Expire(c.negativeKey(tableName), c.negativeTTL)
+	_, err := pipe.Exec()
+	return err
+}
+
+func (c *xOrmRedisCache) clearNegative(tableName string) error {
+	keys, err := c.client.SMembers(c.negativeKey(tableName)).Result()
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+	pipe := c.client.Pipeline()
+	for _, key := range keys {
+		pipe.Del(key)
+	}
+	pipe.Del(c.negativeKey(tableName))
+	_, err = pipe.Exec()
+	return err
+}
+
+// BloomAdd 向table的布隆过滤器加入主键, 没有为table开启布隆过滤器时忽略
+func (c *xOrmRedisCache) BloomAdd(tableName string, pk ...interface{}) {
+	if filter, ok := c.blooms[xOrmCacheBaseTable(tableName)]; ok {
+		id, err := core.NewPK(pk...).ToString()
+		if err != nil {
+			c.error(tableName, "BloomAdd", err)
+			return
+		}
+		filter.add(id)
+	}
+}
+
+// MayExist 主键不在table的布隆过滤器中时返回false, 没有为table开启布隆过滤器时始终返回true
+func (c *xOrmRedisCache) MayExist(tableName string, pk ...interface{}) bool {
+	filter, ok := c.blooms[xOrmCacheBaseTable(tableName)]
+	if !ok {
+		return true
+	}
+	id, err := core.NewPK(pk...).ToString()
+	if err != nil {
+		return true
+	}
+	return filter.contains(id)
+}
+
+type xOrmBloomFilter struct {
+	mu   sync.RWMutex
+	bits []uint64
+	m    uint64 // 位数
+	k    int    // 哈希函数个数
+}
+
+func newXOrmBloomFilter(n uint, p float64) *xOrmBloomFilter {
+	if n == 0 {
+		n = 1
+	}
+	if p <= 0 || p >= 1 {
+		p = 0.01
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	k := int(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &xOrmBloomFilter{bits: make([]uint64, (m+63)/64), m: m, k: k}
+}
+
+// 双重哈希 h1 + i*h2
+func (f *xOrmBloomFilter) locations(key string) []uint64 {
+	sum := sha256.Sum256([]byte(key))
+	h1, h2 := binary.BigEndian.Uint64(sum[:8]), binary.BigEndian.Uint64(sum[8:16])
+	locations := make([]uint64, f.k)
+	for i := range locations {
+		locations[i] = (h1 + uint64(i)*h2) % f.m
+	}
+	return locations
+}
+
+func (f *xOrmBloomFilter) add(key string) {
+	locations := f.locations(key)
+	f.mu.Lock()
+	for _, l := range locations {
+		f.bits[l/64] |= 1 << (l % 64)
+	}
+	f.mu.Unlock()
+}
+
+func (f *xOrmBloomFilter) contains(key string) bool {
+	locations := f.locations(key)
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for _, l := range locations {
+		if f.bits[l/64]&(1<<(l%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -2,41 +2,172 @@ package orm
 
 import (
 	"bytes"
-	"encoding/gob"
-	"hash/crc32"
-	"log"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-redis/redis"
 )
 
+var (
+	xOrmRedisCaches  sync.Map // make(map[*xOrmRedisCache]uint64), 值为创建序号, 用于区分同一个redis库上的多个cache
+	xOrmRedisCacheID uint64
+)
+
+type XOrmRedisCacheOption func(options *xOrmRedisCacheOption)
+
+// XOrmRedisClient xOrmRedisCache使用的redis连接, *redis.Client, *redis.ClusterClient以及*redis.Ring都满足该接口
+type XOrmRedisClient interface {
+	redis.Cmdable
+	Subscribe(channels ...string) *redis.PubSub
+	WrapProcess(fn func(oldProcess func(cmd redis.Cmder) error) func(cmd redis.Cmder) error)
+	WrapProcessPipeline(fn func(oldProcess func([]redis.Cmder) error) func([]redis.Cmder) error)
+	Close() error
+}
+
+type xOrmRedisCacheOption struct {
+	codec             XOrmCacheCodec
+	version           string
+	verify            bool
+	flightWait        time.Duration
+	lockTTL           time.Duration
+	xfetch            float64
+	negativeTTL       time.Duration
+	blooms            map[string]*xOrmBloomFilter
+	idsTTL            time.Duration
+	tableTTLs         map[string]xOrmCacheTTL
+	jitter            float64
+	timeout           time.Duration
+	breakerFailures   int
+	breakerCooldown   time.Duration
+	generations       bool
+	logger            XOrmCacheLogger
+	sinks             []XOrmCacheSink
+	compression       XOrmCacheCompression
+	compressThreshold int
+	namespace         string
+}
+
+// 默认使用XOrmCacheGobCodec
+func XOrmRedisCacheCodec(codec XOrmCacheCodec) XOrmRedisCacheOption {
+	return func(options *xOrmRedisCacheOption) {
+		options.codec = codec
+	}
+}
+
+// 缓存key的版本, 表结构或bean定义变化时修改版本使旧缓存失效
+func XOrmRedisCacheVersion(version string) XOrmRedisCacheOption {
+	return func(options *xOrmRedisCacheOption) {
+		options.version = version
+	}
+}
+
+// 开启后与值一起保存原始的sql/id, 读取时不一致视为未命中
+// 开启或关闭时需要同时修改XOrmRedisCacheVersion, 否则无法读取之前写入的缓存
+func XOrmRedisCacheVerify(verify bool) XOrmRedisCacheOption {
+	return func(options *xOrmRedisCacheOption) {
+		options.verify = verify
+	}
+}
+
 type xOrmRedisCache struct {
-	client     redis.UniversalClient
-	expiration time.Duration
-	bufferPool sync.Pool
+	addr          string // like "127.0.0.1:6379/10"
+	client        XOrmRedisClient
+	expiration    time.Duration
+	codec         XOrmCacheCodec
+	version       string
+	verify        bool
+	flightWait    time.Duration
+	lockTTL       time.Duration
+	xfetch        float64
+	flightMu      sync.Mutex
+	flights       map[string]*xOrmCacheFlight
+	deltas        map[string]time.Duration // 每个表最近一次从未命中到写入的耗时
+	negativeTTL   time.Duration
+	blooms        map[string]*xOrmBloomFilter
+	idsTTL        time.Duration
+	tableTTLs     map[string]xOrmCacheTTL
+	jitter        float64
+	breaker       *xOrmCacheBreaker
+	timeout       time.Duration
+	pendingMu     sync.Mutex
+	pending       map[string]*xOrmCachePending // 熔断期间没有执行的删除
+	pendingTables int32
+	generations   bool
+	logger        XOrmCacheLogger
+	metrics       *xOrmCacheMetrics
+	compression   XOrmCacheCompression
+	threshold     int // 压缩阈值
+	namespace     string
 }
 
-// 使用切片查询时请定义成[]struct{}而不要定义成[]*struct{}类型！！！
-func NewXOrmRedisCache(hosts []string, password string, db int, expiration time.Duration) *xOrmRedisCache {
-	client := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: hosts, Password: password, DB: db})
+func NewXOrmRedisCache(hosts []string, password string, db int, expiration time.Duration, options ...XOrmRedisCacheOption) (*xOrmRedisCache, error) {
+	opts := &xOrmRedisCacheOption{}
+	for _, option := range options {
+		option(opts)
+	}
+	client := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: hosts, Password: password, DB: db,
+		DialTimeout: opts.timeout, ReadTimeout: opts.timeout, WriteTimeout: opts.timeout, PoolTimeout: opts.timeout})
+	cache, err := newXOrmRedisCache(client, strings.Join(hosts, ",")+"/"+strconv.Itoa(db), expiration, options...)
+	if err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+	return cache, nil
+}
+
+// NewXOrmRedisCacheClient 使用已有的redis连接, 例如测试中连接miniredis, XOrmRedisCacheTimeout不修改该连接的读写超时
+// cache.Close时会关闭client
+func NewXOrmRedisCacheClient(client XOrmRedisClient, expiration time.Duration, options ...XOrmRedisCacheOption) (*xOrmRedisCache, error) {
+	return newXOrmRedisCache(client, xOrmRedisClientAddr(client), expiration, options...)
+}
+
+func newXOrmRedisCache(client XOrmRedisClient, addr string, expiration time.Duration, options ...XOrmRedisCacheOption) (*xOrmRedisCache, error) {
+	opts := &xOrmRedisCacheOption{codec: XOrmCacheGobCodec, logger: xOrmStdLogger{}}
+	for _, option := range options {
+		option(opts)
+	}
 	if err := client.Ping().Err(); err != nil {
-		panic(err)
+		return nil, err
 	}
-	return &xOrmRedisCache{client: client, expiration: expiration, bufferPool: sync.Pool{New: func() interface{} {
-		return new(bytes.Buffer)
-	}}}
+	breaker := newXOrmCacheBreaker(addr, opts.logger, opts.breakerFailures, opts.breakerCooldown)
+	client, err := breaker.wrap(client)
+	if err != nil {
+		return nil, err
+	}
+	cache := &xOrmRedisCache{addr: addr, client: client, expiration: expiration, breaker: breaker,
+		timeout: opts.timeout, pending: make(map[string]*xOrmCachePending),
+		codec: opts.codec, version: opts.version, verify: opts.verify,
+		flightWait: opts.flightWait, lockTTL: opts.lockTTL, xfetch: opts.xfetch, flights: make(map[string]*xOrmCacheFlight),
+		negativeTTL: opts.negativeTTL, blooms: opts.blooms, idsTTL: opts.idsTTL, tableTTLs: opts.tableTTLs, jitter: opts.jitter,
+		generations: opts.generations, logger: opts.logger, metrics: newXOrmCacheMetrics(opts.sinks),
+		compression: opts.compression, threshold: opts.compressThreshold, namespace: opts.namespace}
+	xOrmRedisCaches.Store(cache, atomic.AddUint64(&xOrmRedisCacheID, 1))
+	return cache, nil
 }
 
-func (c *xOrmRedisCache) buffer() *bytes.Buffer {
-	return c.bufferPool.Get().(*bytes.Buffer)
+// 用于日志以及健康检查中的名称, like "127.0.0.1:6379/10"
+func xOrmRedisClientAddr(client XOrmRedisClient) string {
+	switch client := client.(type) {
+	case *redis.Client:
+		return client.Options().Addr + "/" + strconv.Itoa(client.Options().DB)
+	case *redis.ClusterClient:
+		return strings.Join(client.Options().Addrs, ",") + "/0"
+	}
+	return fmt.Sprintf("%T", client)
 }
 
-func (c *xOrmRedisCache) revoke(buffer *bytes.Buffer) {
-	buffer.Reset()
-	c.bufferPool.Put(buffer)
+// Close 关闭redis连接
+func (c *xOrmRedisCache) Close() error {
+	xOrmRedisCaches.Delete(c)
+	return c.client.Close()
 }
 
 func (c *xOrmRedisCache) exists(key string) (bool, error) {
@@ -52,21 +183,29 @@ func (c *xOrmRedisCache) exists(key string) (bool, error) {
 
 func (c *xOrmRedisCache) beanKey(tableName, id string) string {
 	if id == "*" {
-		return "xorm:bean:" + tableName + ":*"
+		return c.prefix("xorm:bean:" + tableName + ":*")
 	}
-	crc := crc32.ChecksumIEEE([]byte(id))
-	return "xorm:bean:" + tableName + ":" + strconv.Itoa(int(crc))
+	return c.prefix("xorm:bean:" + tableName + ":" + c.hash(id))
 }
 
+// xorm传入的sql已包含绑定的参数, like "SELECT id FROM t WHERE a = ?-[1]"
 func (c *xOrmRedisCache) sqlKey(tableName, sql string) string {
 	if sql == "*" {
-		return "xorm:sql:" + tableName + ":*"
+		return c.prefix("xorm:sql:" + tableName + ":*")
 	}
-	crc := crc32.ChecksumIEEE([]byte(sql))
-	return "xorm:sql:" + tableName + ":" + strconv.Itoa(int(crc))
+	return c.prefix("xorm:sql:" + tableName + ":" + c.hash(sql))
 }
 
-func (c *xOrmRedisCache) get(key string) (interface{}, error) {
+// SHA-256截取前128位, 版本放在哈希中, ClearBeans/ClearIds可以清除所有版本的缓存
+func (c *xOrmRedisCache) hash(s string) string {
+	h := sha256.New()
+	h.Write([]byte(c.version))
+	h.Write([]byte{0})
+	h.Write([]byte(s))
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+func (c *xOrmRedisCache) get(tableName, key, original string) (interface{}, error) {
 	bs, err := c.client.Get(key).Bytes()
 	if err == redis.Nil {
 		return nil, nil
@@ -74,14 +213,52 @@ func (c *xOrmRedisCache) get(key string) (interface{}, error) {
 	if err != nil {
 		return nil, err
 	}
-	return c.deserialize(bs)
+	c.metrics.bytes(tableName, "read", len(bs))
+	if c.verify {
+		var stored string
+		if stored, bs, err = xOrmCacheUnwrapOriginal(bs); err != nil || stored != original {
+			return nil, nil
+		}
+	}
+	if c.xfetch > 0 {
+		expireAt, delta, payload, err := xOrmCacheUnwrapXFetch(bs)
+		if err != nil { // 开启XFetch前写入的值
+			return nil, nil
+		}
+		if !expireAt.IsZero() && xOrmCacheXFetchExpired(time.Now(), expireAt, delta, c.xfetch) {
+			return nil, nil
+		}
+		bs = payload
+	}
+	if c.negativeTTL > 0 && bytes.Equal(bs, xOrmCacheNegativeSentinel) {
+		return xOrmCacheEmptyIds, nil
+	}
+	value, err := c.deserialize(bs)
+	if err == errCodecUnknownType || err == errCodecInvalidPayload { // 未注册的类型或旧格式的值, 视为未命中
+		return nil, nil
+	}
+	return value, err
 }
 
-func (c *xOrmRedisCache) put(key string, value interface{}) error {
-	return c.invoke(key, value)
+func (c *xOrmRedisCache) put(tableName, key, original string, value interface{}, expiration time.Duration) error {
+	if !c.stampede() {
+		return c.invoke(tableName, key, original, value, expiration)
+	}
+	err := c.invoke(tableName, key, original, value, expiration)
+	c.finish(key, nil, value)
+	return err
+}
+
+// 读取缓存, 开启了防击穿时未命中交给miss处理
+func (c *xOrmRedisCache) fetch(tableName, key, original string) (interface{}, error) {
+	value, err := c.get(tableName, key, original)
+	if err != nil || value != nil || !c.stampede() {
+		return value, err
+	}
+	return c.miss(tableName, key, original), nil
 }
 
-func (c *xOrmRedisCache) del(key ...string) error {
+func (c *xOrmRedisCache) delKeys(key ...string) error {
 	err := c.client.Del(key...).Err()
 	if err != nil && !strings.Contains(err.Error(), "no such key") {
 		return err
@@ -89,110 +266,228 @@ func (c *xOrmRedisCache) del(key ...string) error {
 	return nil
 }
 
-func (c *xOrmRedisCache) delAll(key string) error {
-	var cursor uint64
+func (c *xOrmRedisCache) invoke(tableName, key, original string, value interface{}, expiration time.Duration) error {
+	var bs []byte
 	var err error
-	var keys []string
-next:
-	var scanKeys []string
-	scanKeys, cursor, err = c.client.Scan(cursor, key, 1000).Result()
-	if err == redis.Nil {
-		return nil
-	}
-	if err != nil {
+	if c.negativeTTL > 0 && xOrmCacheIsEmptyIds(value) {
+		bs, expiration = xOrmCacheNegativeSentinel, c.withJitter(c.negativeTTL)
+	} else if bs, err = c.serialize(tableName, value); err != nil {
 		return err
 	}
-	keys = append(keys, scanKeys...)
-	if cursor == 0 {
-		if len(keys) > 0 {
-			return c.del(keys...)
+	if c.xfetch > 0 {
+		var expireAt time.Time
+		if expiration > 0 {
+			expireAt = time.Now().Add(expiration)
 		}
-		return nil
+		bs = xOrmCacheWrapXFetch(expireAt, c.recomputeDelta(tableName, key), bs)
+	}
+	if c.verify {
+		bs = xOrmCacheWrapOriginal(original, bs)
 	}
-	goto next
+	c.metrics.bytes(tableName, "write", len(bs))
+	return c.client.Set(key, bs, expiration).Err()
 }
 
-func (c *xOrmRedisCache) invoke(key string, value interface{}) error {
-	bs, err := c.serialize(value)
+func (c *xOrmRedisCache) serialize(tableName string, value interface{}) ([]byte, error) {
+	bs, err := codecMarshal(c.codec, value)
+	if err != nil || c.compression == XOrmCacheNoCompression || len(bs) < c.threshold {
+		return bs, err
+	}
+	compressed, err := xOrmCacheCompress(c.compression, bs)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return c.client.Set(key, bs, c.expiration).Err()
+	if len(compressed) >= len(bs) {
+		return bs, nil
+	}
+	c.metrics.compress(tableName, len(bs), len(compressed))
+	return compressed, nil
 }
 
-func (c *xOrmRedisCache) serialize(value interface{}) ([]byte, error) {
-	buffer := c.buffer()
-	if err := gob.NewEncoder(buffer).Encode(&value); err != nil {
-		c.revoke(buffer)
-		return nil, err
+func (c *xOrmRedisCache) deserialize(byt []byte) (interface{}, error) {
+	byt, err := xOrmCacheDecompress(byt)
+	if err != nil {
+		return nil, errCodecInvalidPayload
 	}
-	result := buffer.Bytes()
-	c.revoke(buffer)
-	return result, nil
+	return codecUnmarshal(c.codec, byt)
 }
 
-func (c *xOrmRedisCache) deserialize(byt []byte) (ptr interface{}, err error) {
-	buffer := c.buffer()
-	buffer.Write(byt)
-	if err = gob.NewDecoder(buffer).Decode(&ptr); err != nil {
-		c.revoke(buffer)
-		return nil, err
+// 校验模式下的值为 uvarint(len(original)) + original + payload
+func xOrmCacheWrapOriginal(original string, payload []byte) []byte {
+	bs := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(original)+len(payload))
+	bs = append(bs[:binary.PutUvarint(bs, uint64(len(original)))], original...)
+	return append(bs, payload...)
+}
+
+func xOrmCacheUnwrapOriginal(bs []byte) (string, []byte, error) {
+	size, n := binary.Uvarint(bs)
+	if n <= 0 || uint64(len(bs)-n) < size {
+		return "", nil, errors.New("invalid cache payload")
 	}
-	c.revoke(buffer)
-	return ptr, nil
+	return string(bs[n : n+int(size)]), bs[n+int(size):], nil
 }
 
 func (c *xOrmRedisCache) GetIds(tableName, sql string) interface{} {
-	i, err := c.get(c.sqlKey(tableName, sql))
+	if !c.available() {
+		return nil
+	}
+	value, _ := c.withTimeout(tableName, "GetIds", func() interface{} { return c.getIds(tableName, sql) })
+	return value
+}
+
+func (c *xOrmRedisCache) getIds(tableName, sql string) interface{} {
+	defer c.metrics.latency(tableName, "GetIds", time.Now())
+	key, err := c.sqlKeyOf(tableName, sql)
 	if err != nil {
-		log.Printf("[ERROR] Xorm Redis Cacher <GetIds> Error:%s", err.Error())
+		c.error(tableName, "GetIds", err)
 		return nil
 	}
-	return i
+	return c.load(tableName, "GetIds", key, sql)
 }
 
 func (c *xOrmRedisCache) GetBean(tableName string, id string) interface{} {
-	i, err := c.get(c.beanKey(tableName, id))
+	if !c.available() {
+		return nil
+	}
+	value, _ := c.withTimeout(tableName, "GetBean", func() interface{} { return c.getBean(tableName, id) })
+	return value
+}
+
+func (c *xOrmRedisCache) getBean(tableName string, id string) interface{} {
+	defer c.metrics.latency(tableName, "GetBean", time.Now())
+	if filter, ok := c.blooms[xOrmCacheBaseTable(tableName)]; ok && !filter.contains(id) { // 主键一定不存在, 不访问redis
+		c.metrics.count(tableName, XOrmCacheMiss)
+		return nil
+	}
+	key, err := c.beanKeyOf(tableName, id)
 	if err != nil {
-		log.Printf("[ERROR] Xorm Redis Cacher <GetBean> Error:%s \n", err.Error())
+		c.error(tableName, "GetBean", err)
 		return nil
 	}
+	return c.load(tableName, "GetBean", key, id)
+}
+
+func (c *xOrmRedisCache) load(tableName, op, key, original string) interface{} {
+	i, err := c.fetch(tableName, key, original)
+	if err != nil {
+		c.error(tableName, op, err)
+		return nil
+	}
+	if i == nil {
+		c.metrics.count(tableName, XOrmCacheMiss)
+	} else {
+		c.metrics.count(tableName, XOrmCacheHit)
+	}
 	return i
 }
 
 func (c *xOrmRedisCache) PutIds(tableName, sql string, ids interface{}) {
-	if err := c.put(c.sqlKey(tableName, sql), ids); err != nil {
-		log.Printf("[ERROR] Xorm Redis Cacher <PutIds> Error:%s \n", err.Error())
+	if !c.available() {
+		return
+	}
+	c.withTimeout(tableName, "PutIds", func() interface{} { c.putIds(tableName, sql, ids); return nil })
+}
+
+func (c *xOrmRedisCache) putIds(tableName, sql string, ids interface{}) {
+	defer c.metrics.latency(tableName, "PutIds", time.Now())
+	key, err := c.sqlKeyOf(tableName, sql)
+	if err == nil {
+		err = c.put(tableName, key, sql, ids, c.ttl(tableName, true))
+	}
+	if err != nil {
+		c.error(tableName, "PutIds", err)
+		return
+	}
+	c.metrics.count(tableName, XOrmCachePut)
+	if c.negativeTTL > 0 && xOrmCacheIsEmptyIds(ids) {
+		if err := c.addNegative(tableName, key); err != nil {
+			c.error(tableName, "PutIds", err)
+		}
 	}
 }
 
 func (c *xOrmRedisCache) PutBean(tableName string, id string, obj interface{}) {
-	if err := c.put(c.beanKey(tableName, id), obj); err != nil {
-		log.Printf("[ERROR] Xorm Redis Cacher <PutBean> Error:%s \n", err.Error())
+	if !c.available() {
+		return
 	}
+	c.withTimeout(tableName, "PutBean", func() interface{} { c.putBean(tableName, id, obj); return nil })
 }
 
-func (c *xOrmRedisCache) DelIds(tableName, sql string) {
-	log.Println("[Info] Xorm Redis Cacher <DelIds>", tableName, sql)
-	if err := c.del(c.sqlKey(tableName, sql)); err != nil {
-		log.Printf("[ERROR] Xorm Redis Cacher <DelIds> Error:%s \n", err.Error())
+func (c *xOrmRedisCache) putBean(tableName string, id string, obj interface{}) {
+	defer c.metrics.latency(tableName, "PutBean", time.Now())
+	key, err := c.beanKeyOf(tableName, id)
+	if err == nil {
+		err = c.put(tableName, key, id, obj, c.ttl(tableName, false))
+	}
+	if err != nil {
+		c.error(tableName, "PutBean", err)
+	} else {
+		c.metrics.count(tableName, XOrmCachePut)
 	}
+	if filter, ok := c.blooms[xOrmCacheBaseTable(tableName)]; ok {
+		filter.add(id)
+	}
+}
+
+func (c *xOrmRedisCache) DelIds(tableName, sql string) {
+	c.invalidate(tableName, "DelIds", sql)
 }
 
 func (c *xOrmRedisCache) DelBean(tableName string, id string) {
-	if err := c.del(c.beanKey(tableName, id)); err != nil {
-		log.Printf("[ERROR] Xorm Redis Cacher <DelBean> Error:%s \n", err.Error())
-	}
+	c.invalidate(tableName, "DelBean", id)
 }
 
 func (c *xOrmRedisCache) ClearIds(tableName string) {
-	if err := c.delAll(c.sqlKey(tableName, "*")); err != nil {
-		log.Printf("[ERROR] Xorm Redis Cacher <ClearIds> Error:%s \n", err.Error())
-	}
+	c.invalidate(tableName, "ClearIds", "")
 }
 
 func (c *xOrmRedisCache) ClearBeans(tableName string) {
-	if err := c.delAll(c.beanKey(tableName, "*")); err != nil {
-		log.Printf("[ERROR] Xorm Redis Cacher <ClearBeans> Error:%s \n", err.Error())
+	c.invalidate(tableName, "ClearBeans", "")
+}
+
+// 执行删除, 熔断, 超时或连接失败时记录下来, 恢复后重放
+func (c *xOrmRedisCache) invalidate(tableName, op, arg string) {
+	if !c.available() {
+		c.addPending(tableName, op, arg)
+		return
+	}
+	value, ok := c.withTimeout(tableName, op, func() interface{} {
+		defer c.metrics.latency(tableName, op, time.Now())
+		err := c.del(tableName, op, arg)
+		if err != nil {
+			c.error(tableName, op, err)
+		} else {
+			c.metrics.count(tableName, XOrmCacheDelete)
+		}
+		return err
+	})
+	if err, _ := value.(error); !ok || xOrmRedisConnError(err) {
+		c.addPending(tableName, op, arg)
+	}
+}
+
+// 删除ids或bean, 清除表的ids或所有bean
+func (c *xOrmRedisCache) del(tableName, op, arg string) error {
+	var err error
+	switch op {
+	case "DelIds", "DelBean":
+		var key string
+		if op == "DelIds" {
+			key, err = c.sqlKeyOf(tableName, arg)
+		} else {
+			key, err = c.beanKeyOf(tableName, arg)
+		}
+		if err == nil {
+			err = c.delKeys(key)
+		}
+		c.finish(key, nil, nil)
+	case "ClearIds":
+		return c.clear("sql", tableName, c.sqlKey(tableName, "*"))
+	case "ClearBeans":
+		err = c.clear("bean", tableName, c.beanKey(tableName, "*"))
+	}
+	if err != nil || op == "DelIds" || c.negativeTTL <= 0 {
+		return err
 	}
+	return c.clearNegative(tableName)
 }
@@ -0,0 +1,228 @@
+package orm
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math"
+	mrand "math/rand"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+const (
+	xOrmCacheLockPoll       = time.Millisecond * 20 // 等待其他实例写入缓存时的轮询间隔
+	xOrmCacheFlightLifetime = time.Second * 10      // 只开启XFetch时记录未命中时间的最长时间
+	xOrmCacheXFetchHeader   = 16
+	xOrmCacheLockWaitFactor = 4 // 等待锁的时间为表最近查询耗时的倍数, 超过后认为持有锁的实例没有查到记录
+	xOrmCacheLockMinWait    = time.Millisecond * 100
+)
+
+// 释放锁时只删除自己持有的锁
+var xOrmCacheUnlockScript = redis.NewScript(`if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) end return 0`)
+
+// 开启后同一进程内同一个key未命中时只有第一个调用返回nil去查询数据库
+// 其余调用最多等待wait, 期间第一个调用PutBean/PutIds的值会直接返回, 超时仍返回nil
+func XOrmRedisCacheSingleflight(wait time.Duration) XOrmRedisCacheOption {
+	return func(options *xOrmRedisCacheOption) {
+		options.flightWait = wait
+	}
+}
+
+// 开启后未命中时使用redis SET NX加锁, ttl为锁的有效期
+// 没有拿到锁的实例等待持有锁的实例写入缓存, 锁释放或超时后返回nil
+// Find等查询结果为空时会写入空的id列表并释放锁, 但xorm的Get查不到记录时不会调用cacher, 持有锁的实例无法得知,
+// 因此在已经观测到该表查询耗时的情况下最多等待耗时的xOrmCacheLockWaitFactor倍(不少于100ms), 否则最多等待ttl
+func XOrmRedisCacheLock(ttl time.Duration) XOrmRedisCacheOption {
+	return func(options *xOrmRedisCacheOption) {
+		options.lockTTL = ttl
+	}
+}
+
+// 开启XFetch概率提前过期, beta越大越早刷新, 通常为1, 需要设置过期时间
+// 值中会额外保存过期时间以及上次从未命中到写入的耗时, 开启或关闭时需要同时修改XOrmRedisCacheVersion
+func XOrmRedisCacheXFetch(beta float64) XOrmRedisCacheOption {
+	return func(options *xOrmRedisCacheOption) {
+		options.xfetch = beta
+	}
+}
+
+// 一次未命中到PutBean/PutIds的过程
+type xOrmCacheFlight struct {
+	start time.Time
+	done  chan struct{}
+	value interface{}
+	token string // 持有的redis锁
+}
+
+func (c *xOrmRedisCache) stampede() bool {
+	return c.flightWait > 0 || c.lockTTL > 0 || c.xfetch > 0
+}
+
+// 未命中时决定由谁查询数据库, 返回nil表示调用方需要查询数据库
+func (c *xOrmRedisCache) miss(tableName, key, original string) interface{} {
+	c.flightMu.Lock()
+	if f, ok := c.flights[key]; ok {
+		c.flightMu.Unlock()
+		if c.flightWait <= 0 {
+			return nil
+		}
+		select {
+		case <-f.done:
+			return f.value
+		case <-time.After(c.flightWait):
+			return nil
+		}
+	}
+	f := &xOrmCacheFlight{start: time.Now(), done: make(chan struct{})}
+	c.flights[key] = f
+	c.flightMu.Unlock()
+
+	lifetime := xOrmCacheFlightLifetime
+	if c.flightWait > 0 || c.lockTTL > 0 {
+		lifetime = c.flightWait
+		if c.lockTTL > lifetime {
+			lifetime = c.lockTTL
+		}
+	}
+	time.AfterFunc(lifetime, func() { c.finish(key, f, nil) }) // 查询数据库失败或记录不存在时不会写入
+
+	if c.lockTTL > 0 {
+		locked, err := c.lock(key, f)
+		if err != nil {
+			c.error(tableName, "Lock", err)
+		} else if !locked {
+			if value := c.waitRemote(tableName, key, original); value != nil {
+				c.finish(key, f, value)
+				return value
+			}
+		}
+	}
+	return nil
+}
+
+// 结束key上的flight, 唤醒等待的调用
+func (c *xOrmRedisCache) finish(key string, f *xOrmCacheFlight, value interface{}) {
+	c.flightMu.Lock()
+	if f == nil {
+		f = c.flights[key]
+	}
+	if f == nil || c.flights[key] != f {
+		c.flightMu.Unlock()
+		return
+	}
+	delete(c.flights, key)
+	f.value = value
+	close(f.done)
+	c.flightMu.Unlock()
+	if f.token != "" {
+		if err := xOrmCacheUnlockScript.Run(c.client, []string{key + ":lock"}, f.token).Err(); err != nil && err != redis.Nil {
+			c.logger.Printf("[ERROR] Xorm Redis Cacher <Unlock> Error:%s \n", err.Error())
+		}
+	}
+}
+
+// 当前flight已经开始的时间, 用于XFetch
+func (c *xOrmRedisCache) flightDelta(key string) time.Duration {
+	c.flightMu.Lock()
+	defer c.flightMu.Unlock()
+	if f, ok := c.flights[key]; ok {
+		return time.Since(f.start)
+	}
+	return 0
+}
+
+func (c *xOrmRedisCache) lock(key string, f *xOrmCacheFlight) (bool, error) {
+	bs := make([]byte, 16)
+	if _, err := rand.Read(bs); err != nil {
+		return false, err
+	}
+	token := hex.EncodeToString(bs)
+	locked, err := c.client.SetNX(key+":lock", token, c.lockTTL).Result()
+	if err != nil || !locked {
+		return false, err
+	}
+	c.flightMu.Lock()
+	f.token = token
+	c.flightMu.Unlock()
+	return true, nil
+}
+
+// 等待持有锁的实例写入缓存
+func (c *xOrmRedisCache) waitRemote(tableName, key, original string) interface{} {
+	wait := c.lockTTL
+	c.flightMu.Lock()
+	if delta := c.deltas[tableName] * xOrmCacheLockWaitFactor; delta > 0 && delta < wait {
+		wait = delta
+		if wait < xOrmCacheLockMinWait {
+			wait = xOrmCacheLockMinWait
+		}
+		if wait > c.lockTTL {
+			wait = c.lockTTL
+		}
+	}
+	c.flightMu.Unlock()
+	deadline := time.Now().Add(wait)
+	for time.Now().Before(deadline) {
+		time.Sleep(xOrmCacheLockPoll)
+		value, err := c.get(tableName, key, original)
+		if err != nil {
+			return nil
+		}
+		if value != nil {
+			return value
+		}
+		if exists, err := c.exists(key + ":lock"); err != nil || !exists {
+			return nil
+		}
+	}
+	return nil
+}
+
+// 写入时记录的重新计算耗时, 没有flight时(如Find查询后逐个写入的bean)使用该表最近一次的耗时
+func (c *xOrmRedisCache) recomputeDelta(tableName, key string) time.Duration {
+	delta := c.flightDelta(key)
+	c.flightMu.Lock()
+	defer c.flightMu.Unlock()
+	if delta > 0 {
+		if c.deltas == nil {
+			c.deltas = make(map[string]time.Duration)
+		}
+		c.deltas[tableName] = delta
+		return delta
+	}
+	return c.deltas[tableName]
+}
+
+// XFetch的值为 过期时间(unix纳秒, 0表示不过期) + 上次重新计算的耗时(纳秒) + payload
+func xOrmCacheWrapXFetch(expireAt time.Time, delta time.Duration, payload []byte) []byte {
+	bs := make([]byte, xOrmCacheXFetchHeader, xOrmCacheXFetchHeader+len(payload))
+	if !expireAt.IsZero() {
+		binary.BigEndian.PutUint64(bs, uint64(expireAt.UnixNano()))
+	}
+	binary.BigEndian.PutUint64(bs[8:], uint64(delta))
+	return append(bs, payload...)
+}
+
+func xOrmCacheUnwrapXFetch(bs []byte) (time.Time, time.Duration, []byte, error) {
+	if len(bs) < xOrmCacheXFetchHeader {
+		return time.Time{}, 0, nil, errors.New("invalid cache payload")
+	}
+	var expireAt time.Time
+	if nano := int64(binary.BigEndian.Uint64(bs)); nano != 0 {
+		expireAt = time.Unix(0, nano)
+	}
+	delta := time.Duration(binary.BigEndian.Uint64(bs[8:]))
+	return expireAt, delta, bs[xOrmCacheXFetchHeader:], nil
+}
+
+// now - delta * beta * ln(rand) >= expiry 时提前过期
+func xOrmCacheXFetchExpired(now, expireAt time.Time, delta time.Duration, beta float64) bool {
+	if delta <= 0 {
+		return false
+	}
+	early := time.Duration(-float64(delta) * beta * math.Log(1-mrand.Float64()))
+	return !now.Add(early).Before(expireAt)
+}
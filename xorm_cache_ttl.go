@@ -0,0 +1,67 @@
+package orm
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+type xOrmCacheTTL struct {
+	bean time.Duration
+	ids  time.Duration
+}
+
+// id列表的过期时间, 默认与bean相同即NewXOrmRedisCache的expiration
+func XOrmRedisCacheIdsTTL(ttl time.Duration) XOrmRedisCacheOption {
+	return func(options *xOrmRedisCacheOption) {
+		options.idsTTL = ttl
+	}
+}
+
+// 单独设置table的bean与id列表的过期时间, 为0时使用默认的过期时间, 对所有租户有效
+func XOrmRedisCacheTableTTL(table string, bean, ids time.Duration) XOrmRedisCacheOption {
+	return func(options *xOrmRedisCacheOption) {
+		if options.tableTTLs == nil {
+			options.tableTTLs = make(map[string]xOrmCacheTTL)
+		}
+		options.tableTTLs[table] = xOrmCacheTTL{bean: bean, ids: ids}
+	}
+}
+
+// 过期时间随机增加[0, ttl*jitter), 避免同时写入的缓存同时过期, jitter通常为0.1
+func XOrmRedisCacheJitter(jitter float64) XOrmRedisCacheOption {
+	return func(options *xOrmRedisCacheOption) {
+		options.jitter = jitter
+	}
+}
+
+var (
+	xOrmCacheJitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	xOrmCacheJitterLock sync.Mutex
+)
+
+// 返回table的bean或id列表的过期时间
+func (c *xOrmRedisCache) ttl(tableName string, ids bool) time.Duration {
+	ttl := c.expiration
+	if ids && c.idsTTL > 0 {
+		ttl = c.idsTTL
+	}
+	if tableTTL, ok := c.tableTTLs[xOrmCacheBaseTable(tableName)]; ok {
+		if ids && tableTTL.ids > 0 {
+			ttl = tableTTL.ids
+		} else if !ids && tableTTL.bean > 0 {
+			ttl = tableTTL.bean
+		}
+	}
+	return c.withJitter(ttl)
+}
+
+func (c *xOrmRedisCache) withJitter(ttl time.Duration) time.Duration {
+	if ttl <= 0 || c.jitter <= 0 {
+		return ttl
+	}
+	xOrmCacheJitterLock.Lock()
+	f := xOrmCacheJitterRand.Float64()
+	xOrmCacheJitterLock.Unlock()
+	return ttl + time.Duration(float64(ttl)*c.jitter*f)
+}
@@ -0,0 +1,198 @@
+package orm
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"xorm.io/core"
+)
+
+const (
+	xOrmLocalBean = iota
+	xOrmLocalIds
+)
+
+type xOrmLocalKey struct {
+	kind  int
+	table string
+	key   string // bean为id, ids为sql
+}
+
+type xOrmLocalEntry struct {
+	key      xOrmLocalKey
+	value    interface{}
+	expireAt time.Time // 零值表示不过期
+}
+
+// 有容量上限和过期时间的进程内LRU
+type xOrmLocalCache struct {
+	size   int
+	ttl    time.Duration
+	mu     sync.Mutex
+	lru    *list.List // 头部为最近使用
+	items  map[xOrmLocalKey]*list.Element
+	tables map[xOrmLocalKey]map[xOrmLocalKey]struct{} // {kind, table} => keys, 用于按表清除
+}
+
+func newXOrmLocalCache(size int, ttl time.Duration) *xOrmLocalCache {
+	return &xOrmLocalCache{
+		size:   size,
+		ttl:    ttl,
+		lru:    list.New(),
+		items:  make(map[xOrmLocalKey]*list.Element),
+		tables: make(map[xOrmLocalKey]map[xOrmLocalKey]struct{}),
+	}
+}
+
+func (c *xOrmLocalCache) get(key xOrmLocalKey) interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.items[key]
+	if !ok {
+		return nil
+	}
+	entry := elem.Value.(*xOrmLocalEntry)
+	if !entry.expireAt.IsZero() && time.Now().After(entry.expireAt) {
+		c.remove(elem)
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	return entry.value
+}
+
+func (c *xOrmLocalCache) put(key xOrmLocalKey, value interface{}) {
+	if c.size <= 0 {
+		return
+	}
+	var expireAt time.Time
+	if c.ttl > 0 {
+		expireAt = time.Now().Add(c.ttl)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.items[key]; ok {
+		entry := elem.Value.(*xOrmLocalEntry)
+		entry.value, entry.expireAt = value, expireAt
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.items[key] = c.lru.PushFront(&xOrmLocalEntry{key: key, value: value, expireAt: expireAt})
+	table := xOrmLocalKey{kind: key.kind, table: key.table}
+	if c.tables[table] == nil {
+		c.tables[table] = make(map[xOrmLocalKey]struct{})
+	}
+	c.tables[table][key] = struct{}{}
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *xOrmLocalCache) del(key xOrmLocalKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.items[key]; ok {
+		c.remove(elem)
+	}
+}
+
+func (c *xOrmLocalCache) clear(kind int, tableName string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.tables[xOrmLocalKey{kind: kind, table: tableName}] {
+		c.remove(c.items[key])
+	}
+}
+
+// 清空所有表
+func (c *xOrmLocalCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Init()
+	c.items = make(map[xOrmLocalKey]*list.Element)
+	c.tables = make(map[xOrmLocalKey]map[xOrmLocalKey]struct{})
+}
+
+func (c *xOrmLocalCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+func (c *xOrmLocalCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*xOrmLocalEntry)
+	delete(c.items, entry.key)
+	table := xOrmLocalKey{kind: entry.key.kind, table: entry.key.table}
+	if keys := c.tables[table]; keys != nil {
+		delete(keys, entry.key)
+		if len(keys) == 0 {
+			delete(c.tables, table)
+		}
+	}
+}
+
+type xOrmTwoTierCache struct {
+	local  *xOrmLocalCache
+	remote core.Cacher
+}
+
+// NewXOrmTwoTierCache 在remote(通常为NewXOrmRedisCache)之前增加一层进程内LRU缓存
+// size为进程内最多缓存的bean与id列表总数, ttl为进程内缓存的过期时间, 0表示只受容量限制
+// 进程内缓存返回的是同一个对象, 不要修改查询得到的bean
+func NewXOrmTwoTierCache(remote core.Cacher, size int, ttl time.Duration) *xOrmTwoTierCache {
+	return &xOrmTwoTierCache{local: newXOrmLocalCache(size, ttl), remote: remote}
+}
+
+func (c *xOrmTwoTierCache) GetIds(tableName, sql string) interface{} {
+	key := xOrmLocalKey{kind: xOrmLocalIds, table: tableName, key: sql}
+	if ids := c.local.get(key); ids != nil {
+		return ids
+	}
+	ids := c.remote.GetIds(tableName, sql)
+	if ids != nil {
+		c.local.put(key, ids)
+	}
+	return ids
+}
+
+func (c *xOrmTwoTierCache) GetBean(tableName string, id string) interface{} {
+	key := xOrmLocalKey{kind: xOrmLocalBean, table: tableName, key: id}
+	if bean := c.local.get(key); bean != nil {
+		return bean
+	}
+	bean := c.remote.GetBean(tableName, id)
+	if bean != nil {
+		c.local.put(key, bean)
+	}
+	return bean
+}
+
+func (c *xOrmTwoTierCache) PutIds(tableName, sql string, ids interface{}) {
+	c.local.put(xOrmLocalKey{kind: xOrmLocalIds, table: tableName, key: sql}, ids)
+	c.remote.PutIds(tableName, sql, ids)
+}
+
+func (c *xOrmTwoTierCache) PutBean(tableName string, id string, obj interface{}) {
+	c.local.put(xOrmLocalKey{kind: xOrmLocalBean, table: tableName, key: id}, obj)
+	c.remote.PutBean(tableName, id, obj)
+}
+
+func (c *xOrmTwoTierCache) DelIds(tableName, sql string) {
+	c.local.del(xOrmLocalKey{kind: xOrmLocalIds, table: tableName, key: sql})
+	c.remote.DelIds(tableName, sql)
+}
+
+func (c *xOrmTwoTierCache) DelBean(tableName string, id string) {
+	c.local.del(xOrmLocalKey{kind: xOrmLocalBean, table: tableName, key: id})
+	c.remote.DelBean(tableName, id)
+}
+
+func (c *xOrmTwoTierCache) ClearIds(tableName string) {
+	c.local.clear(xOrmLocalIds, tableName)
+	c.remote.ClearIds(tableName)
+}
+
+func (c *xOrmTwoTierCache) ClearBeans(tableName string) {
+	c.local.clear(xOrmLocalBean, tableName)
+	c.remote.ClearBeans(tableName)
+}
@@ -1,19 +1,23 @@
 package orm
 
 import (
+	"database/sql"
 	"errors"
+	"fmt"
 	"github.com/go-xorm/xorm"
 	"sync"
+	"time"
 )
 
 const (
 	xOrmRandomPolicy = iota
 	xOrmLeastConnPolicy
 	xOrmRoundRobinPolicy
+	xOrmCustomPolicy
 )
 
 var (
-	xOrmEngineGroup sync.Map // make(map[string]*xorm.EngineGroup)
+	xOrmEngineGroup sync.Map // make(map[string]*xOrmGroup)
 )
 
 type xOrmGroupOption struct {
@@ -24,6 +28,16 @@ type xOrmGroupOption struct {
 	realPolicy xorm.GroupPolicy
 	weight     []int
 	isWeight   bool
+	zones      map[*xorm.Engine]string
+	// 不可用slave探测
+	probeInterval time.Duration
+	probeTimeout  time.Duration
+	onSlaveState  XOrmSlaveStateFunc
+	// 复制延迟检测
+	maxLag         time.Duration
+	heartbeatTable string
+	// 写后读粘滞窗口
+	stickyWindow time.Duration
 }
 
 type XOrmGroupOption func(*xOrmGroupOption)
@@ -52,10 +66,31 @@ func XOrmSlave(slave *xorm.Engine, weight int) XOrmGroupOption {
 	}
 }
 
+// 与XOrmSlave相同,同时设置slave所在的可用区,用于XOrmZoneAffinityPolicy
+func XOrmSlaveZone(slave *xorm.Engine, weight int, zone string) XOrmGroupOption {
+	return func(option *xOrmGroupOption) {
+		XOrmSlave(slave, weight)(option)
+		if option.zones == nil {
+			option.zones = make(map[*xorm.Engine]string)
+		}
+		option.zones[slave] = zone
+	}
+}
+
+// 使用自定义的GroupPolicy,设置的权重值不会替换自定义策略
+// 自定义策略收到的EngineGroup.Slaves()为初始化时配置的slave, 选中已剔除或移除的slave时改为在可用slave中轮询
+func XOrmUsePolicy(policy xorm.GroupPolicy) XOrmGroupOption {
+	return func(option *xOrmGroupOption) {
+		option.policy = map[int]xorm.GroupPolicy{
+			xOrmCustomPolicy: policy,
+		}
+	}
+}
+
 func XOrmUseRandomPolicy() XOrmGroupOption {
 	return func(option *xOrmGroupOption) {
 		option.policy = map[int]xorm.GroupPolicy{
-			xOrmRandomPolicy: xorm.RandomPolicy(),
+			xOrmRandomPolicy: xOrmRandomSlaves(),
 		}
 	}
 }
@@ -63,7 +98,7 @@ func XOrmUseRandomPolicy() XOrmGroupOption {
 func XOrmUseLeastConnPolicy() XOrmGroupOption {
 	return func(option *xOrmGroupOption) {
 		option.policy = map[int]xorm.GroupPolicy{
-			xOrmLeastConnPolicy: xorm.LeastConnPolicy(),
+			xOrmLeastConnPolicy: xOrmLeastConnSlaves(),
 		}
 	}
 }
@@ -71,13 +106,59 @@ func XOrmUseLeastConnPolicy() XOrmGroupOption {
 func XOrmUseRoundRobinPolicy() XOrmGroupOption {
 	return func(option *xOrmGroupOption) {
 		option.policy = map[int]xorm.GroupPolicy{
-			xOrmRoundRobinPolicy: xorm.RoundRobinPolicy(),
+			xOrmRoundRobinPolicy: xOrmRoundRobinSlaves(),
 		}
 	}
 }
 
+// 每隔interval探测一次slave,探测失败的slave会被移出读请求路由,恢复后重新加入
+// 所有slave都不可用时读请求回退到master
+func XOrmGroupProbeInterval(interval time.Duration) XOrmGroupOption {
+	return func(option *xOrmGroupOption) {
+		option.probeInterval = interval
+	}
+}
+
+// 单次探测的超时时间,默认与探测间隔相同
+func XOrmGroupProbeTimeout(timeout time.Duration) XOrmGroupOption {
+	return func(option *xOrmGroupOption) {
+		option.probeTimeout = timeout
+	}
+}
+
+// slave被剔除或恢复时回调
+func XOrmGroupSlaveState(fn XOrmSlaveStateFunc) XOrmGroupOption {
+	return func(option *xOrmGroupOption) {
+		option.onSlaveState = fn
+	}
+}
+
+// 复制延迟超过max的slave会被移出读请求路由,延迟恢复后重新加入
+// 未设置XOrmGroupProbeInterval时默认每5秒检测一次
+func XOrmGroupMaxReplicationLag(max time.Duration) XOrmGroupOption {
+	return func(option *xOrmGroupOption) {
+		option.maxLag = max
+	}
+}
+
+// 使用master上的心跳表代替SHOW SLAVE STATUS测量复制延迟
+// 心跳表结构为 (id INT PRIMARY KEY, ts BIGINT), 不存在时自动创建
+// 心跳每隔 max/4 (不超过探测间隔) 写入一次, 测量的延迟最多比实际大一个心跳间隔
+func XOrmGroupLagHeartbeat(table string) XOrmGroupOption {
+	return func(option *xOrmGroupOption) {
+		option.heartbeatTable = table
+	}
+}
+
+// ctx写入后读请求路由到master的时间窗口,默认为0即ctx整个生命周期
+func XOrmGroupStickyWindow(window time.Duration) XOrmGroupOption {
+	return func(option *xOrmGroupOption) {
+		option.stickyWindow = window
+	}
+}
+
 func initXOrmGroupOptions(options ...XOrmGroupOption) (*xOrmGroupOption, error) {
-	defaultPolicy := xorm.RoundRobinPolicy()
+	defaultPolicy := xOrmRoundRobinSlaves()
 	opts := &xOrmGroupOption{realPolicy: defaultPolicy, policy: map[int]xorm.GroupPolicy{
 		xOrmRoundRobinPolicy: defaultPolicy,
 	}}
@@ -95,20 +176,127 @@ func initXOrmGroupOptions(options ...XOrmGroupOption) (*xOrmGroupOption, error)
 			return nil, errors.New("xorm engine slaves has a empty value")
 		}
 	}
-	// 如果设置权重值,则自动切换GroupPolicy为WeightPolicy
-	for k, _ := range opts.policy {
+	for k, policy := range opts.policy {
+		if k != xOrmCustomPolicy {
+			continue
+		}
+		if policy == nil {
+			return nil, errors.New("xorm engine group policy is empty")
+		}
+		if zoneAware, ok := policy.(xOrmZoneAware); ok {
+			for slave, zone := range opts.zones {
+				zoneAware.setZone(slave, zone)
+			}
+		}
+		if _, ok := policy.(XOrmLatencyObserver); ok && opts.probeInterval <= 0 {
+			opts.probeInterval = xOrmDefaultProbeInterval
+		}
+	}
+	if opts.maxLag > 0 && opts.probeInterval <= 0 {
+		opts.probeInterval = xOrmDefaultProbeInterval
+	}
+	opts.realPolicy = opts.groupPolicy(opts.weight)
+	return opts, nil
+}
+
+// 如果设置权重值,则自动切换GroupPolicy为WeightPolicy
+func (opts *xOrmGroupOption) groupPolicy(weight []int) xorm.GroupPolicy {
+	policy := opts.realPolicy
+	for k, p := range opts.policy {
+		policy = p
 		if opts.isWeight {
 			switch k {
 			case xOrmRandomPolicy:
-				opts.realPolicy = xorm.WeightRandomPolicy(opts.weight)
+				policy = xOrmWeightRandomSlaves(weight)
 			case xOrmRoundRobinPolicy, xOrmLeastConnPolicy:
-				opts.realPolicy = xorm.WeightRoundRobinPolicy(opts.weight)
+				policy = xOrmWeightRoundRobinSlaves(weight)
+			case xOrmCustomPolicy: // 自定义策略自行处理权重
 			default:
-				opts.realPolicy = xorm.WeightRoundRobinPolicy(opts.weight)
+				policy = xOrmWeightRoundRobinSlaves(weight)
 			}
 		}
 	}
-	return opts, nil
+	return policy
+}
+
+// xOrmGroup 保存分组的完整配置, group只创建一次, 读请求由router在可用的slave中选择
+type xOrmGroup struct {
+	name      string
+	opts      *xOrmGroupOption
+	mu        sync.RWMutex
+	group     *xorm.EngineGroup
+	router    *xOrmGroupRouter
+	unhealthy map[*xorm.Engine]error
+	lags      map[*xorm.Engine]time.Duration
+	done      chan struct{}
+	closeOnce sync.Once
+	running   sync.WaitGroup // 探测以及心跳goroutine
+}
+
+func newXOrmGroup(opts *xOrmGroupOption) (*xOrmGroup, error) {
+	g := &xOrmGroup{
+		name:      opts.name,
+		opts:      opts,
+		unhealthy: make(map[*xorm.Engine]error),
+		lags:      make(map[*xorm.Engine]time.Duration),
+		done:      make(chan struct{}),
+		router:    &xOrmGroupRouter{master: opts.master},
+	}
+	g.reroute()
+	// EngineGroup.Slave()在slave少于两个时不经过策略, 用master补足使读请求始终由router选择
+	slaves := append(make([]*xorm.Engine, 0, 2), opts.slaves...)
+	for len(slaves) < 2 {
+		slaves = append(slaves, opts.master)
+	}
+	engineGroup, err := xorm.NewEngineGroup(opts.master, slaves, g.router)
+	if err != nil {
+		return nil, err
+	}
+	g.group = engineGroup
+	return g, nil
+}
+
+// 所有配置的engine, master在第一个
+func (g *xOrmGroup) engines() []*xorm.Engine {
+	return append([]*xorm.Engine{g.opts.master}, g.slaves()...)
+}
+
+// 所有配置的slave, opts.slaves只会整体替换,返回的切片可以在锁外使用
+func (g *xOrmGroup) slaves() []*xorm.Engine {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.opts.slaves
+}
+
+func (g *xOrmGroup) policy() xorm.GroupPolicy {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.opts.realPolicy
+}
+
+// 根据slave状态替换router的可用slave以及对应权重的策略,调用方需持有g.mu写锁
+// 没有可用slave时读请求路由到master
+func (g *xOrmGroup) reroute() {
+	slaves := make([]*xorm.Engine, 0, len(g.opts.slaves))
+	weight := make([]int, 0, len(g.opts.slaves))
+	for i, slave := range g.opts.slaves {
+		if _, ok := g.unhealthy[slave]; ok {
+			continue
+		}
+		slaves = append(slaves, slave)
+		weight = append(weight, g.opts.weight[i])
+	}
+	policy := g.opts.realPolicy
+	if len(slaves) != len(g.opts.slaves) {
+		policy = g.opts.groupPolicy(weight)
+	}
+	g.router.store(slaves, policy)
+}
+
+// 停止探测以及心跳, 返回时goroutine都已退出, 之后可以安全关闭engine
+func (g *xOrmGroup) stop() {
+	g.closeOnce.Do(func() { close(g.done) })
+	g.running.Wait()
 }
 
 func InitXOrmEngineGroup(options ...XOrmGroupOption) error {
@@ -116,21 +304,86 @@ func InitXOrmEngineGroup(options ...XOrmGroupOption) error {
 	if err != nil {
 		return err
 	}
-	if engineGroup, err := xorm.NewEngineGroup(opts.master, opts.slaves, opts.realPolicy); err != nil {
+	g, err := newXOrmGroup(opts)
+	if err != nil {
 		return err
-	} else {
-		xOrmGroupRegister(opts.name, engineGroup)
 	}
+	if opts.probeInterval > 0 {
+		g.running.Add(1)
+		go g.startProber()
+	}
+	xOrmGroupRegister(opts.name, g)
 	return nil
 }
 
-func xOrmGroupRegister(name string, group *xorm.EngineGroup) {
+func xOrmGroupRegister(name string, group *xOrmGroup) {
+	old, loaded := xOrmEngineGroup.Load(name)
 	xOrmEngineGroup.Store(name, group)
+	if loaded && old != nil && old != group { // 重复初始化时排空并释放旧分组独占的engine
+		o := old.(*xOrmGroup)
+		o.stop()
+		var dbs []*sql.DB
+		for _, engine := range o.engines() {
+			dbs = append(dbs, engine.DB().DB)
+		}
+		drainClose("xorm engine group '"+name+"'", func() error { return xOrmGroupRelease(o) }, dbs...)
+	}
+}
+
+// CloseXOrmEngineGroup 注销指定名称的xorm engine group
+// 分组中仍以名称注册在XOrmEngine中或属于其他分组的engine不会被关闭,需要通过CloseXOrmEngine关闭
+func CloseXOrmEngineGroup(name string) error {
+	if g := xOrmGroupLoad(name); g != nil {
+		xOrmEngineGroup.Delete(name)
+		g.stop()
+		return xOrmGroupRelease(g)
+	}
+	return nil
+}
+
+// 关闭group中既没有单独注册,也不属于其他已注册分组的engine
+func xOrmGroupRelease(group *xOrmGroup) error {
+	var errs ormErrors
+	for _, engine := range group.engines() {
+		if xOrmEngineInUse(engine) {
+			continue
+		}
+		if err := engine.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs.err()
 }
 
+// engine是否以名称注册在XOrmEngine中或属于某个已注册的分组
+func xOrmEngineInUse(engine *xorm.Engine) (inUse bool) {
+	if xOrmEngineRegistered(engine) {
+		return true
+	}
+	xOrmEngineGroup.Range(func(key, value interface{}) bool {
+		for _, e := range value.(*xOrmGroup).engines() {
+			if e == engine {
+				inUse = true
+				break
+			}
+		}
+		return !inUse
+	})
+	return
+}
+
+func xOrmGroupLoad(group string) *xOrmGroup {
+	if g, ok := xOrmEngineGroup.Load(group); ok && g != nil {
+		return g.(*xOrmGroup)
+	}
+	return nil
+}
+
+// XOrmEngineGroup 返回分组的EngineGroup, EngineGroup只在初始化时创建
+// 其Slaves()为初始化时配置的slave, 当前参与读请求路由的slave见XOrmEngineHealthySlaves
 func XOrmEngineGroup(group string) *xorm.EngineGroup {
-	if engineGroup, ok := xOrmEngineGroup.Load(group); ok && engineGroup != nil {
-		return engineGroup.(*xorm.EngineGroup)
+	if g := xOrmGroupLoad(group); g != nil {
+		return g.group
 	}
 	return nil
 }
@@ -149,9 +402,108 @@ func XOrmEngineSlave(group string) *xorm.Engine {
 	return nil
 }
 
+// XOrmGroupAddSlave 向已注册的分组添加slave并重新计算权重策略
+func XOrmGroupAddSlave(group string, slave *xorm.Engine, weight int) error {
+	g := xOrmGroupLoad(group)
+	if g == nil {
+		return fmt.Errorf("xorm engine group '%s' not found", group)
+	}
+	if slave == nil {
+		return errors.New("xorm engine slave is empty")
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, s := range g.opts.slaves {
+		if s == slave {
+			return fmt.Errorf("xorm engine group '%s' already has the slave", group)
+		}
+	}
+	// 复制切片,已经返回给调用方的切片保持不变
+	g.opts.slaves = append(g.opts.slaves[:len(g.opts.slaves):len(g.opts.slaves)], slave)
+	g.opts.weight = append(g.opts.weight[:len(g.opts.weight):len(g.opts.weight)], weight)
+	if weight > 0 {
+		g.opts.isWeight = true
+	}
+	g.opts.realPolicy = g.opts.groupPolicy(g.opts.weight)
+	g.reroute()
+	return nil
+}
+
+// XOrmGroupRemoveSlave 从已注册的分组移除slave
+// 移除后新的读请求不再路由到该slave,如果它没有以名称注册或属于其他分组,会在排空后关闭
+func XOrmGroupRemoveSlave(group string, slave *xorm.Engine) error {
+	g := xOrmGroupLoad(group)
+	if g == nil {
+		return fmt.Errorf("xorm engine group '%s' not found", group)
+	}
+	g.mu.Lock()
+	idx := -1
+	for i, s := range g.opts.slaves {
+		if s == slave {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		g.mu.Unlock()
+		return fmt.Errorf("xorm engine group '%s' does not have the slave", group)
+	}
+	slaves := make([]*xorm.Engine, 0, len(g.opts.slaves)-1)
+	weight := make([]int, 0, len(g.opts.weight)-1)
+	slaves = append(append(slaves, g.opts.slaves[:idx]...), g.opts.slaves[idx+1:]...)
+	weight = append(append(weight, g.opts.weight[:idx]...), g.opts.weight[idx+1:]...)
+	g.opts.slaves, g.opts.weight = slaves, weight
+	g.opts.isWeight = false
+	for _, w := range weight {
+		if w > 0 {
+			g.opts.isWeight = true
+		}
+	}
+	delete(g.unhealthy, slave)
+	delete(g.lags, slave)
+	g.opts.realPolicy = g.opts.groupPolicy(g.opts.weight)
+	g.reroute()
+	g.mu.Unlock()
+	drainClose("xorm engine group '"+group+"' slave", func() error {
+		if xOrmEngineInUse(slave) {
+			return nil
+		}
+		return slave.Close()
+	}, slave.DB().DB)
+	return nil
+}
+
+// XOrmEngineSlaves 返回分组配置的所有slave,包含已被剔除的不可用slave
 func XOrmEngineSlaves(group string) []*xorm.Engine {
-	if g := XOrmEngineGroup(group); g != nil {
-		return g.Slaves()
+	if g := xOrmGroupLoad(group); g != nil {
+		return g.slaves()
+	}
+	return nil
+}
+
+// XOrmEngineSlaveLags 返回与XOrmEngineSlaves一一对应的复制延迟,未检测时为XOrmLagUnknown
+func XOrmEngineSlaveLags(group string) []time.Duration {
+	g := xOrmGroupLoad(group)
+	if g == nil {
+		return nil
+	}
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	lags := make([]time.Duration, len(g.opts.slaves))
+	for i, slave := range g.opts.slaves {
+		if lag, ok := g.lags[slave]; ok {
+			lags[i] = lag
+		} else {
+			lags[i] = XOrmLagUnknown
+		}
+	}
+	return lags
+}
+
+// XOrmEngineHealthySlaves 返回当前参与读请求路由的slave
+func XOrmEngineHealthySlaves(group string) []*xorm.Engine {
+	if g := xOrmGroupLoad(group); g != nil {
+		return g.router.load().slaves
 	}
 	return nil
 }
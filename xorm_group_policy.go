@@ -0,0 +1,378 @@
+package orm
+
+import (
+	"context"
+	"hash/crc32"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-xorm/xorm"
+)
+
+// XOrmContextPolicy 可以根据ctx选择slave的GroupPolicy, 通过XOrmEngineSlaveContext以及XOrmGroupSession使用
+// XOrmEngineSlave以及xorm的EngineGroup没有ctx, 使用策略的Slave方法
+type XOrmContextPolicy interface {
+	xorm.GroupPolicy
+	SlaveContext(ctx context.Context, g *xorm.EngineGroup) *xorm.Engine
+}
+
+// XOrmLatencyObserver 接收slave查询耗时的GroupPolicy
+// XOrmGroupRead中读操作的耗时以及分组探测的ping耗时会自动上报, 其他方式执行的查询可以通过XOrmObserveLatency上报
+type XOrmLatencyObserver interface {
+	xorm.GroupPolicy
+	Observe(slave *xorm.Engine, latency time.Duration)
+}
+
+// 需要知道slave所在可用区的GroupPolicy,由XOrmSlaveZone设置
+type xOrmZoneAware interface {
+	setZone(slave *xorm.Engine, zone string)
+}
+
+type xOrmHashKey struct{}
+
+// XOrmWithHashKey 设置一致性哈希使用的key,相同key的读请求会落到同一个slave
+func XOrmWithHashKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, xOrmHashKey{}, key)
+}
+
+// XOrmEngineSlaveContext 分组使用XOrmContextPolicy时按ctx选择slave,否则与XOrmEngineSlave相同
+func XOrmEngineSlaveContext(ctx context.Context, group string) *xorm.Engine {
+	if g := xOrmGroupLoad(group); g != nil {
+		return g.router.SlaveContext(ctx, g.group)
+	}
+	return nil
+}
+
+// 在给定的可用slave中选择, slaves至少有两个
+// 内置策略以及本包的策略都实现该接口, 增删或剔除slave时不需要重新创建EngineGroup
+type xOrmSlavePicker interface {
+	pick(slaves []*xorm.Engine) *xorm.Engine
+}
+
+type xOrmContextPicker interface {
+	pickContext(ctx context.Context, slaves []*xorm.Engine) *xorm.Engine
+}
+
+// xOrmGroupRouter 是分组EngineGroup实际使用的GroupPolicy, EngineGroup只在初始化时创建一次
+// slave的增删以及剔除恢复只替换route, 不修改engine以及EngineGroup, 可以与查询并发
+type xOrmGroupRouter struct {
+	master *xorm.Engine
+	route  atomic.Value // *xOrmGroupRoute
+	pos    uint32
+}
+
+type xOrmGroupRoute struct {
+	slaves []*xorm.Engine // 可用的slave
+	policy xorm.GroupPolicy
+}
+
+func (r *xOrmGroupRouter) store(slaves []*xorm.Engine, policy xorm.GroupPolicy) {
+	r.route.Store(&xOrmGroupRoute{slaves: slaves, policy: policy})
+}
+
+func (r *xOrmGroupRouter) load() *xOrmGroupRoute {
+	return r.route.Load().(*xOrmGroupRoute)
+}
+
+func (r *xOrmGroupRouter) Slave(g *xorm.EngineGroup) *xorm.Engine {
+	route := r.load()
+	if len(route.slaves) < 2 {
+		return r.single(route)
+	}
+	if picker, ok := route.policy.(xOrmSlavePicker); ok {
+		return picker.pick(route.slaves)
+	}
+	return r.check(route, route.policy.Slave(g))
+}
+
+func (r *xOrmGroupRouter) SlaveContext(ctx context.Context, g *xorm.EngineGroup) *xorm.Engine {
+	route := r.load()
+	if len(route.slaves) < 2 {
+		return r.single(route)
+	}
+	switch policy := route.policy.(type) {
+	case xOrmContextPicker:
+		return policy.pickContext(ctx, route.slaves)
+	case XOrmContextPolicy:
+		return r.check(route, policy.SlaveContext(ctx, g))
+	}
+	return r.Slave(g)
+}
+
+// 没有可用slave时使用master
+func (r *xOrmGroupRouter) single(route *xOrmGroupRoute) *xorm.Engine {
+	if len(route.slaves) == 0 {
+		return r.master
+	}
+	return route.slaves[0]
+}
+
+// 自定义策略看到的EngineGroup.Slaves()是初始化时的slave, 选中已剔除或移除的slave时在可用slave中轮询
+func (r *xOrmGroupRouter) check(route *xOrmGroupRoute, slave *xorm.Engine) *xorm.Engine {
+	for _, s := range route.slaves {
+		if s == slave {
+			return slave
+		}
+	}
+	return route.slaves[int((atomic.AddUint32(&r.pos, 1)-1)%uint32(len(route.slaves)))]
+}
+
+// xOrmSlicePolicy 在给定的slave中选择, 与xorm的同名内置策略相同
+type xOrmSlicePolicy func(slaves []*xorm.Engine) *xorm.Engine
+
+func (p xOrmSlicePolicy) Slave(g *xorm.EngineGroup) *xorm.Engine {
+	return p(g.Slaves())
+}
+
+func (p xOrmSlicePolicy) pick(slaves []*xorm.Engine) *xorm.Engine {
+	return p(slaves)
+}
+
+func xOrmRandomSlaves() xOrmSlicePolicy {
+	var mu sync.Mutex
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	return func(slaves []*xorm.Engine) *xorm.Engine {
+		mu.Lock()
+		defer mu.Unlock()
+		return slaves[r.Intn(len(slaves))]
+	}
+}
+
+func xOrmWeightRandomSlaves(weight []int) xOrmSlicePolicy {
+	var mu sync.Mutex
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	indexes := xOrmWeightIndexes(weight)
+	return func(slaves []*xorm.Engine) *xorm.Engine {
+		mu.Lock()
+		defer mu.Unlock()
+		return xOrmWeightSlave(slaves, indexes, r.Intn(len(indexes)))
+	}
+}
+
+func xOrmRoundRobinSlaves() xOrmSlicePolicy {
+	var pos uint32
+	return func(slaves []*xorm.Engine) *xorm.Engine {
+		return slaves[int((atomic.AddUint32(&pos, 1)-1)%uint32(len(slaves)))]
+	}
+}
+
+func xOrmWeightRoundRobinSlaves(weight []int) xOrmSlicePolicy {
+	var pos uint32
+	indexes := xOrmWeightIndexes(weight)
+	return func(slaves []*xorm.Engine) *xorm.Engine {
+		return xOrmWeightSlave(slaves, indexes, int((atomic.AddUint32(&pos, 1)-1)%uint32(len(indexes))))
+	}
+}
+
+func xOrmLeastConnSlaves() xOrmSlicePolicy {
+	return func(slaves []*xorm.Engine) *xorm.Engine {
+		idx, min := 0, -1
+		for i, slave := range slaves {
+			if conns := slave.DB().Stats().OpenConnections; min < 0 || conns <= min {
+				idx, min = i, conns
+			}
+		}
+		return slaves[idx]
+	}
+}
+
+// 每个slave下标按权重重复, 权重都为0时视为相同权重
+func xOrmWeightIndexes(weight []int) []int {
+	indexes := make([]int, 0, len(weight))
+	for i, w := range weight {
+		for n := 0; n < w; n++ {
+			indexes = append(indexes, i)
+		}
+	}
+	if len(indexes) == 0 {
+		for i := range weight {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+func xOrmWeightSlave(slaves []*xorm.Engine, indexes []int, n int) *xorm.Engine {
+	if len(indexes) == 0 {
+		return slaves[0]
+	}
+	idx := indexes[n]
+	if idx >= len(slaves) {
+		idx = len(slaves) - 1
+	}
+	return slaves[idx]
+}
+
+// XOrmObserveLatency 向分组的XOrmLatencyObserver上报slave的查询耗时
+func XOrmObserveLatency(group string, slave *xorm.Engine, latency time.Duration) {
+	if g := xOrmGroupLoad(group); g != nil {
+		if observer, ok := g.policy().(XOrmLatencyObserver); ok {
+			observer.Observe(slave, latency)
+		}
+	}
+}
+
+type xOrmLatencyPolicy struct {
+	decay float64
+	mu    sync.Mutex
+	ewma  map[*xorm.Engine]float64
+	pos   int
+}
+
+// XOrmLatencyPolicy 选择查询耗时EWMA最低的slave, decay为新样本的权重(0, 1], 默认0.3
+// 没有样本的slave视为耗时为0, 会被优先尝试
+func XOrmLatencyPolicy(decay float64) XOrmLatencyObserver {
+	if decay <= 0 || decay > 1 {
+		decay = 0.3
+	}
+	return &xOrmLatencyPolicy{decay: decay, ewma: make(map[*xorm.Engine]float64)}
+}
+
+func (p *xOrmLatencyPolicy) Observe(slave *xorm.Engine, latency time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if old, ok := p.ewma[slave]; ok {
+		p.ewma[slave] = old + p.decay*(float64(latency)-old)
+	} else {
+		p.ewma[slave] = float64(latency)
+	}
+}
+
+func (p *xOrmLatencyPolicy) Slave(g *xorm.EngineGroup) *xorm.Engine {
+	return p.pick(g.Slaves())
+}
+
+func (p *xOrmLatencyPolicy) pick(slaves []*xorm.Engine) *xorm.Engine {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pos++ // 轮换起点,耗时相同时均匀分布
+	idx, min := 0, -1.0
+	for n := 0; n < len(slaves); n++ {
+		i := (p.pos + n) % len(slaves)
+		if latency := p.ewma[slaves[i]]; min < 0 || latency < min {
+			idx, min = i, latency
+		}
+	}
+	return slaves[idx]
+}
+
+type xOrmZonePolicy struct {
+	zone  string
+	mu    sync.Mutex
+	zones map[*xorm.Engine]string
+	pos   int
+}
+
+// XOrmZoneAffinityPolicy 优先在与当前进程可用区zone相同的slave之间轮询
+// slave的可用区由XOrmSlaveZone设置, 没有同区slave时在所有slave之间轮询
+func XOrmZoneAffinityPolicy(zone string) xorm.GroupPolicy {
+	return &xOrmZonePolicy{zone: zone, zones: make(map[*xorm.Engine]string)}
+}
+
+func (p *xOrmZonePolicy) setZone(slave *xorm.Engine, zone string) {
+	p.mu.Lock()
+	p.zones[slave] = zone
+	p.mu.Unlock()
+}
+
+func (p *xOrmZonePolicy) Slave(g *xorm.EngineGroup) *xorm.Engine {
+	return p.pick(g.Slaves())
+}
+
+func (p *xOrmZonePolicy) pick(slaves []*xorm.Engine) *xorm.Engine {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	candidates := make([]*xorm.Engine, 0, len(slaves))
+	for _, slave := range slaves {
+		if p.zones[slave] == p.zone {
+			candidates = append(candidates, slave)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = slaves
+	}
+	p.pos++
+	return candidates[p.pos%len(candidates)]
+}
+
+type xOrmHashPolicy struct {
+	vnodes   int
+	fallback xOrmSlicePolicy
+	mu       sync.Mutex
+	slaves   []*xorm.Engine // 生成ring时的slave
+	ring     []uint32
+	nodes    map[uint32]*xorm.Engine
+}
+
+// XOrmConsistentHashPolicy 按XOrmWithHashKey设置的key一致性哈希选择slave, vnodes为每个slave的虚拟节点数,默认100
+// 通过XOrmEngineSlaveContext或XOrmGroupSession按key选择slave, 没有key或没有ctx时(XOrmEngineSlave)轮询
+func XOrmConsistentHashPolicy(vnodes int) XOrmContextPolicy {
+	if vnodes <= 0 {
+		vnodes = 100
+	}
+	return &xOrmHashPolicy{vnodes: vnodes, fallback: xOrmRoundRobinSlaves()}
+}
+
+func (p *xOrmHashPolicy) Slave(g *xorm.EngineGroup) *xorm.Engine {
+	return p.pick(g.Slaves())
+}
+
+func (p *xOrmHashPolicy) pick(slaves []*xorm.Engine) *xorm.Engine {
+	return p.fallback(slaves)
+}
+
+func (p *xOrmHashPolicy) SlaveContext(ctx context.Context, g *xorm.EngineGroup) *xorm.Engine {
+	return p.pickContext(ctx, g.Slaves())
+}
+
+func (p *xOrmHashPolicy) pickContext(ctx context.Context, slaves []*xorm.Engine) *xorm.Engine {
+	key, ok := ctx.Value(xOrmHashKey{}).(string)
+	if !ok {
+		return p.fallback(slaves)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !xOrmSameEngines(p.slaves, slaves) {
+		p.build(slaves)
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(p.ring), func(i int) bool { return p.ring[i] >= h })
+	if i == len(p.ring) {
+		i = 0
+	}
+	return p.nodes[p.ring[i]]
+}
+
+// 以DataSourceName生成虚拟节点,保证不同进程对相同key选择相同的slave
+func (p *xOrmHashPolicy) build(slaves []*xorm.Engine) {
+	p.slaves = slaves
+	p.ring = make([]uint32, 0, len(slaves)*p.vnodes)
+	p.nodes = make(map[uint32]*xorm.Engine, len(slaves)*p.vnodes)
+	for _, slave := range slaves {
+		for v := 0; v < p.vnodes; v++ {
+			h := crc32.ChecksumIEEE([]byte(slave.DataSourceName() + "#" + strconv.Itoa(v)))
+			if _, ok := p.nodes[h]; ok {
+				continue
+			}
+			p.nodes[h] = slave
+			p.ring = append(p.ring, h)
+		}
+	}
+	sort.Slice(p.ring, func(i, j int) bool { return p.ring[i] < p.ring[j] })
+}
+
+func xOrmSameEngines(a, b []*xorm.Engine) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
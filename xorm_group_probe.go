@@ -0,0 +1,196 @@
+package orm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/go-xorm/xorm"
+)
+
+// XOrmLagUnknown 未开启延迟检测或检测失败时的复制延迟
+const XOrmLagUnknown = time.Duration(-1)
+
+// 只设置XOrmGroupMaxReplicationLag时的默认探测间隔
+const xOrmDefaultProbeInterval = time.Second * 5
+
+// 心跳的最小写入间隔
+const xOrmMinHeartbeatInterval = time.Millisecond * 10
+
+// XOrmSlaveStateFunc slave状态变化回调, index为slave在XOrmEngineSlaves中的下标, healthy为false时err为探测错误
+type XOrmSlaveStateFunc func(group string, index int, slave *xorm.Engine, healthy bool, err error)
+
+func (g *xOrmGroup) startProber() {
+	defer g.running.Done()
+	if g.opts.heartbeatTable != "" && g.opts.maxLag > 0 {
+		g.running.Add(1)
+		go g.startHeartbeat()
+	}
+	ticker := time.NewTicker(g.opts.probeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-g.done:
+			return
+		case <-ticker.C:
+			g.probe()
+		}
+	}
+}
+
+// 探测所有slave,状态有变化时替换router的可用slave, EngineGroup以及engine不变
+func (g *xOrmGroup) probe() {
+	timeout := g.opts.probeTimeout
+	if timeout <= 0 {
+		timeout = g.opts.probeInterval
+	}
+	slaves := g.slaves() // 探测期间slave可能被增删,按engine而不是下标对应结果
+	errs := make([]error, len(slaves))
+	lags := make([]time.Duration, len(slaves))
+	observer, _ := g.policy().(XOrmLatencyObserver)
+	for i, slave := range slaves {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		lags[i] = XOrmLagUnknown
+		start := time.Now()
+		errs[i] = slave.DB().PingContext(ctx)
+		if errs[i] == nil && observer != nil {
+			observer.Observe(slave, time.Since(start))
+		}
+		if errs[i] == nil && g.opts.maxLag > 0 {
+			if lags[i], errs[i] = g.replicationLag(ctx, slave); errs[i] == nil && lags[i] > g.opts.maxLag {
+				errs[i] = fmt.Errorf("replication lag %s exceeds %s", lags[i], g.opts.maxLag)
+			}
+		}
+		cancel()
+	}
+
+	type change struct {
+		index   int
+		slave   *xorm.Engine
+		healthy bool
+		err     error
+	}
+	var changes []change
+	g.mu.Lock()
+	current := make(map[*xorm.Engine]int, len(g.opts.slaves))
+	for i, slave := range g.opts.slaves {
+		current[slave] = i
+	}
+	for i, slave := range slaves {
+		index, ok := current[slave]
+		if !ok { // 已被移除
+			continue
+		}
+		g.lags[slave] = lags[i]
+		_, unhealthy := g.unhealthy[slave]
+		switch {
+		case errs[i] != nil && !unhealthy:
+			g.unhealthy[slave] = errs[i]
+			changes = append(changes, change{index: index, slave: slave, err: errs[i]})
+		case errs[i] != nil:
+			g.unhealthy[slave] = errs[i]
+		case unhealthy:
+			delete(g.unhealthy, slave)
+			changes = append(changes, change{index: index, slave: slave, healthy: true})
+		}
+	}
+	if len(changes) > 0 {
+		g.reroute()
+	}
+	g.mu.Unlock()
+
+	for _, c := range changes {
+		if c.healthy {
+			log.Printf("[INFO] xorm engine group '%s' slave%d recovered", g.name, c.index)
+		} else {
+			log.Printf("[ERROR] xorm engine group '%s' slave%d evicted: %v", g.name, c.index, c.err)
+		}
+		if g.opts.onSlaveState != nil {
+			g.opts.onSlaveState(g.name, c.index, c.slave, c.healthy, c.err)
+		}
+	}
+}
+
+// 测量slave的复制延迟
+// 设置了心跳表时使用 当前时间 - slave上读到的心跳时间, 否则使用SHOW SLAVE STATUS的Seconds_Behind_Master
+func (g *xOrmGroup) replicationLag(ctx context.Context, slave *xorm.Engine) (time.Duration, error) {
+	if g.opts.heartbeatTable != "" {
+		var ts int64
+		row := slave.DB().QueryRowContext(ctx, "SELECT ts FROM "+g.opts.heartbeatTable+" WHERE id = 1")
+		if err := row.Scan(&ts); err != nil {
+			return XOrmLagUnknown, err
+		}
+		if lag := time.Duration(time.Now().UnixNano() - ts); lag > 0 {
+			return lag, nil
+		}
+		return 0, nil
+	}
+	results, err := slave.Context(ctx).QueryString("SHOW SLAVE STATUS")
+	if err != nil {
+		return XOrmLagUnknown, err
+	}
+	if len(results) == 0 {
+		return XOrmLagUnknown, errors.New("slave status is empty")
+	}
+	seconds, ok := results[0]["Seconds_Behind_Master"]
+	if !ok || seconds == "" { // NULL表示复制线程没有运行
+		return XOrmLagUnknown, errors.New("replication is not running")
+	}
+	n, err := strconv.ParseInt(seconds, 10, 64)
+	if err != nil {
+		return XOrmLagUnknown, err
+	}
+	return time.Duration(n) * time.Second, nil
+}
+
+// 心跳间隔为 maxLag/4, 不超过探测间隔, 使测量的延迟与实际延迟的差距远小于maxLag
+func (g *xOrmGroup) heartbeatInterval() time.Duration {
+	interval := g.opts.maxLag / 4
+	if interval > g.opts.probeInterval {
+		interval = g.opts.probeInterval
+	}
+	if interval < xOrmMinHeartbeatInterval {
+		interval = xOrmMinHeartbeatInterval
+	}
+	return interval
+}
+
+// 独立于探测, 按heartbeatInterval向master写入心跳
+func (g *xOrmGroup) startHeartbeat() {
+	defer g.running.Done()
+	interval := g.heartbeatInterval()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	created := false
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		err := g.writeHeartbeat(ctx, !created)
+		cancel()
+		if err != nil {
+			log.Printf("[ERROR] xorm engine group '%s' write heartbeat error: %v", g.name, err)
+		} else {
+			created = true
+		}
+		select {
+		case <-g.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// 向master的心跳表写入当前时间(纳秒), create时先创建心跳表
+func (g *xOrmGroup) writeHeartbeat(ctx context.Context, create bool) error {
+	db := g.opts.master.DB()
+	if create {
+		if _, err := db.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+g.opts.heartbeatTable+
+			" (id INT NOT NULL PRIMARY KEY, ts BIGINT NOT NULL)"); err != nil {
+			return err
+		}
+	}
+	_, err := db.ExecContext(ctx, "REPLACE INTO "+g.opts.heartbeatTable+" (id, ts) VALUES (1, ?)", time.Now().UnixNano())
+	return err
+}
@@ -0,0 +1,110 @@
+package orm
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-xorm/xorm"
+)
+
+type xOrmStickyKey struct{}
+
+// 记录ctx中每个分组最后一次写入的时间
+type xOrmSticky struct {
+	mu      sync.Mutex
+	written map[string]time.Time
+}
+
+// XOrmStickyContext 返回可以记录写操作的ctx,一般在请求入口调用一次
+// 通过XOrmMarkWritten标记写入后,该ctx在分组的粘滞窗口内的读请求都会路由到master
+func XOrmStickyContext(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(xOrmStickyKey{}).(*xOrmSticky); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, xOrmStickyKey{}, &xOrmSticky{written: make(map[string]time.Time)})
+}
+
+// XOrmMarkWritten 标记ctx已写入group, ctx没有经过XOrmStickyContext时返回false
+func XOrmMarkWritten(ctx context.Context, group string) bool {
+	sticky, ok := ctx.Value(xOrmStickyKey{}).(*xOrmSticky)
+	if !ok {
+		return false
+	}
+	sticky.mu.Lock()
+	sticky.written[group] = time.Now()
+	sticky.mu.Unlock()
+	return true
+}
+
+// XOrmIsSticky ctx在group的粘滞窗口内是否有写入
+func XOrmIsSticky(ctx context.Context, group string) bool {
+	sticky, ok := ctx.Value(xOrmStickyKey{}).(*xOrmSticky)
+	if !ok {
+		return false
+	}
+	sticky.mu.Lock()
+	written, ok := sticky.written[group]
+	sticky.mu.Unlock()
+	if !ok {
+		return false
+	}
+	var window time.Duration
+	if g := xOrmGroupLoad(group); g != nil {
+		window = g.opts.stickyWindow
+	}
+	return window <= 0 || time.Since(written) < window
+}
+
+// XOrmGroupSession 返回绑定ctx的读会话
+// ctx在粘滞窗口内有写入时使用master, 否则使用分组策略按ctx选择的slave(见XOrmEngineSlaveContext)
+// 返回的是所选engine上的普通会话, 写操作使用XOrmGroupWriteSession
+func XOrmGroupSession(ctx context.Context, group string) *xorm.Session {
+	if engine := xOrmGroupReadEngine(ctx, group); engine != nil {
+		return engine.NewSession().Context(ctx)
+	}
+	return nil
+}
+
+// XOrmGroupWriteSession 标记ctx已写入并返回绑定ctx的master会话
+func XOrmGroupWriteSession(ctx context.Context, group string) *xorm.Session {
+	master := XOrmEngineMaster(group)
+	if master == nil {
+		return nil
+	}
+	XOrmMarkWritten(ctx, group)
+	return master.NewSession().Context(ctx)
+}
+
+// XOrmGroupSQLSession 根据sql语句类型选择会话,写语句会标记ctx已写入
+func XOrmGroupSQLSession(ctx context.Context, group, sql string) *xorm.Session {
+	if ormIsReadSQL(sql) {
+		return XOrmGroupSession(ctx, group)
+	}
+	return XOrmGroupWriteSession(ctx, group)
+}
+
+// XOrmGroupRead 在XOrmGroupSession选择的engine上执行读操作fn, 执行后关闭会话
+// 读请求落到slave且fn成功时, 耗时会上报给分组的XOrmLatencyObserver
+func XOrmGroupRead(ctx context.Context, group string, fn func(session *xorm.Session) error) error {
+	engine := xOrmGroupReadEngine(ctx, group)
+	if engine == nil {
+		return fmt.Errorf("xorm engine group '%s' not found", group)
+	}
+	session := engine.NewSession().Context(ctx)
+	defer session.Close()
+	start := time.Now()
+	err := fn(session)
+	if err == nil && engine != XOrmEngineMaster(group) {
+		XOrmObserveLatency(group, engine, time.Since(start))
+	}
+	return err
+}
+
+func xOrmGroupReadEngine(ctx context.Context, group string) *xorm.Engine {
+	if XOrmIsSticky(ctx, group) {
+		return XOrmEngineMaster(group)
+	}
+	return XOrmEngineSlaveContext(ctx, group)
+}
@@ -1,10 +1,29 @@
 package orm
 
 import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/go-xorm/xorm"
+	"github.com/marcosxz/orm/internal/redistest"
+	_ "github.com/mattn/go-sqlite3"
+	"xorm.io/core"
 )
 
 type String string
@@ -19,18 +38,35 @@ type xOrmTestBean struct {
 	V  int     `xorm:"version"`
 }
 
+// 测试用的sqlite文件, 测试结束时删除
+func ormTestSQLite(t *testing.T, name string) string {
+	dir, err := ioutil.TempDir("", "orm")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return "file:" + filepath.Join(dir, name) + "?_busy_timeout=5000"
+}
+
 func TestInitXOrmEngine(t *testing.T) {
+	s, _ := redistest.New(t)
+	cache, err := NewXOrmRedisCache([]string{s.Addr()}, "", 10, time.Second*60)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
 	if err := InitXOrmEngine(
 		XOrmEngineName("default"),
-		XOrmDriver("mysql"),
-		XOrmDataSource("root:root@tcp(127.0.0.1:3306)/test?charset=utf8"),
+		XOrmDriver("sqlite3"),
+		XOrmDataSource(ormTestSQLite(t, "default")),
 		XOrmMaxIdleConn(10),
 		XOrmMaxOpenConn(10),
 		XOrmLogger(os.Stderr),
 		XOrmConnMaxLifetime(time.Second*60),
 		XOrmMapper(XOrmSnakeMapper),
 		XOrmShowSQL(true),
-		XOrmDefaultCache(NewXOrmRedisCache([]string{"127.0.0.1:6379"}, "", 10, time.Second*60)),
+		XOrmDefaultCache(cache),
 		XOrmSync(&xOrmTestBean{}),
 	); err != nil {
 		t.Error(err)
@@ -59,6 +95,12 @@ func TestXOrmSession(t *testing.T) {
 		t.Logf("XOrmSession Successful: %v \n", session)
 		defer session.Close()
 
+		// 插入
+		if _, err := session.Insert(&xOrmTestBean{A: "a", B: 1.1, C: true, D: Slice{"d"}}); err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+
 		// 查询
 		var res1 xOrmTestBean
 		if _, err := session.Where("id = ?", 1).Get(&res1); err != nil {
@@ -102,8 +144,8 @@ func TestInitXOrmEngineGroup(t *testing.T) {
 	// master
 	if err := InitXOrmEngine(
 		XOrmEngineName("master"),
-		XOrmDriver("mysql"),
-		XOrmDataSource("root:root@tcp(127.0.0.1:3306)/test?charset=utf8"),
+		XOrmDriver("sqlite3"),
+		XOrmDataSource(ormTestSQLite(t, "master")),
 		XOrmMaxIdleConn(10),
 		XOrmMaxOpenConn(10),
 		XOrmConnMaxLifetime(time.Second*60),
@@ -119,8 +161,8 @@ func TestInitXOrmEngineGroup(t *testing.T) {
 	// slave1
 	if err := InitXOrmEngine(
 		XOrmEngineName("slave1"),
-		XOrmDriver("mysql"),
-		XOrmDataSource("root:root@tcp(127.0.0.1:3307)/test?charset=utf8"),
+		XOrmDriver("sqlite3"),
+		XOrmDataSource(ormTestSQLite(t, "slave1")),
 		XOrmMaxIdleConn(10),
 		XOrmMaxOpenConn(10),
 		XOrmConnMaxLifetime(time.Second*60),
@@ -136,8 +178,8 @@ func TestInitXOrmEngineGroup(t *testing.T) {
 	// slave2
 	if err := InitXOrmEngine(
 		XOrmEngineName("slave2"),
-		XOrmDriver("mysql"),
-		XOrmDataSource("root:root@tcp(127.0.0.1:3308)/test?charset=utf8"),
+		XOrmDriver("sqlite3"),
+		XOrmDataSource(ormTestSQLite(t, "slave2")),
 		XOrmMaxIdleConn(10),
 		XOrmMaxOpenConn(10),
 		XOrmConnMaxLifetime(time.Second*60),
@@ -203,3 +245,1640 @@ func TestXOrmEngineSlaves(t *testing.T) {
 		t.Logf("XOrmEngineSlaves Successful: %v \n", slaves)
 	}
 }
+
+func TestXOrmEngineGroupProbe(t *testing.T) {
+	for _, name := range []string{"probe_master", "probe_slave1", "probe_slave2"} {
+		if err := InitXOrmEngine(
+			XOrmEngineName(name),
+			XOrmDriver("mysql"),
+			XOrmDataSource("root:root@tcp(127.0.0.1:1)/test?timeout=1s"),
+		); err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+	}
+	evicted := make(chan int, 2)
+	if err := InitXOrmEngineGroup(
+		XOrmGroupName("probe"),
+		XOrmMaster(XOrmEngine("probe_master")),
+		XOrmSlave(XOrmEngine("probe_slave1"), 1),
+		XOrmSlave(XOrmEngine("probe_slave2"), 2),
+		XOrmGroupProbeInterval(time.Hour),
+		XOrmGroupMaxReplicationLag(time.Second),
+		XOrmGroupSlaveState(func(group string, index int, slave *xorm.Engine, healthy bool, err error) {
+			if !healthy {
+				evicted <- index
+			}
+		}),
+	); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer CloseXOrmEngineGroup("probe")
+
+	xOrmGroupLoad("probe").probe()
+	if len(evicted) != 2 {
+		t.Errorf("expected 2 evicted slaves, got %d", len(evicted))
+	}
+	if slaves := XOrmEngineHealthySlaves("probe"); len(slaves) != 0 {
+		t.Errorf("expected no healthy slaves, got %d", len(slaves))
+	}
+	if len(XOrmEngineSlaves("probe")) != 2 {
+		t.Error("XOrmEngineSlaves should return all configured slaves")
+	}
+	for i, lag := range XOrmEngineSlaveLags("probe") {
+		if lag != XOrmLagUnknown {
+			t.Errorf("slave%d lag should be unknown, got %s", i, lag)
+		}
+	}
+	if XOrmEngineSlave("probe") != XOrmEngine("probe_master") {
+		t.Error("XOrmEngineSlave should fall back to master when no slave is healthy")
+	}
+}
+
+// 使用-race运行, 探测剔除以及恢复slave与分组上的查询并发
+func TestXOrmEngineGroupProbeRace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "orm")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	// 每个engine中的行数不同, 通过Count判断读请求落到的engine
+	var engines []*xorm.Engine
+	for i, name := range []string{"probe_race_master", "probe_race_slave1", "probe_race_slave2"} {
+		if err := InitXOrmEngine(
+			XOrmEngineName(name),
+			XOrmDriver("sqlite3"),
+			XOrmDataSource("file:"+filepath.Join(dir, name)+"?_busy_timeout=5000"),
+			XOrmSync2(&xOrmStickyBean{}),
+		); err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		defer CloseXOrmEngine(name)
+		for n := 0; n < i; n++ {
+			if _, err := XOrmEngine(name).Insert(&xOrmStickyBean{A: name}); err != nil {
+				t.Error(err)
+				t.FailNow()
+			}
+		}
+		if _, err := XOrmEngine(name).Exec("CREATE TABLE heartbeat (id INT NOT NULL PRIMARY KEY, ts BIGINT NOT NULL)"); err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		engines = append(engines, XOrmEngine(name))
+	}
+	var evicted, recovered int32
+	if err := InitXOrmEngineGroup(
+		XOrmGroupName("probe_race"),
+		XOrmMaster(engines[0]),
+		XOrmSlave(engines[1], 0),
+		XOrmSlave(engines[2], 0),
+		XOrmGroupProbeInterval(time.Hour),
+		XOrmGroupMaxReplicationLag(time.Hour),
+		XOrmGroupLagHeartbeat("heartbeat"),
+		XOrmGroupSlaveState(func(group string, index int, slave *xorm.Engine, healthy bool, err error) {
+			if healthy {
+				atomic.AddInt32(&recovered, 1)
+			} else {
+				atomic.AddInt32(&evicted, 1)
+			}
+		}),
+	); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer CloseXOrmEngineGroup("probe_race")
+
+	// slave1始终可用, slave2交替缺少心跳被剔除以及恢复, 读请求不应路由到master
+	heartbeat := func(slave *xorm.Engine) {
+		if _, err := slave.Exec("REPLACE INTO heartbeat (id, ts) VALUES (1, ?)", time.Now().UnixNano()); err != nil {
+			t.Error(err)
+		}
+	}
+	heartbeat(engines[1])
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				session := XOrmEngineGroup("probe_race").NewSession()
+				count, err := session.Count(&xOrmStickyBean{})
+				session.Close()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if count < 1 || count > 2 {
+					t.Errorf("read routed to master, count %d", count)
+					return
+				}
+			}
+		}()
+	}
+	g := xOrmGroupLoad("probe_race")
+	for i := 0; i < 20; i++ {
+		if i%2 == 0 {
+			if _, err := engines[2].Exec("DELETE FROM heartbeat"); err != nil {
+				t.Error(err)
+			}
+		} else {
+			heartbeat(engines[2])
+		}
+		g.probe()
+	}
+	close(stop)
+	wg.Wait()
+	if evicted != 10 || recovered != 10 {
+		t.Errorf("expected 10 evictions and recoveries, got %d and %d", evicted, recovered)
+	}
+}
+
+func TestXOrmEngineGroupLagHeartbeat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "orm")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"lag_master", "lag_slave"} {
+		if err := InitXOrmEngine(
+			XOrmEngineName(name),
+			XOrmDriver("sqlite3"),
+			XOrmDataSource("file:"+filepath.Join(dir, name)+"?_busy_timeout=5000"),
+		); err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		defer CloseXOrmEngine(name)
+	}
+	master, slave := XOrmEngine("lag_master"), XOrmEngine("lag_slave")
+	if _, err := slave.Exec("CREATE TABLE heartbeat (id INT NOT NULL PRIMARY KEY, ts BIGINT NOT NULL)"); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	// slave始终落后master一次心跳写入
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		var last, previous int64
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Millisecond * 5):
+			}
+			var ts int64
+			if err := master.DB().QueryRow("SELECT ts FROM heartbeat WHERE id = 1").Scan(&ts); err != nil || ts == last {
+				continue
+			}
+			previous, last = last, ts
+			if previous > 0 {
+				_, _ = slave.Exec("REPLACE INTO heartbeat (id, ts) VALUES (1, ?)", previous)
+			}
+		}
+	}()
+	evicted := make(chan error, 1)
+	if err := InitXOrmEngineGroup(
+		XOrmGroupName("lag"),
+		XOrmMaster(master),
+		XOrmSlave(slave, 0),
+		XOrmGroupProbeInterval(time.Millisecond*300),
+		XOrmGroupMaxReplicationLag(time.Millisecond*200),
+		XOrmGroupLagHeartbeat("heartbeat"),
+		XOrmGroupSlaveState(func(group string, index int, slave *xorm.Engine, healthy bool, err error) {
+			if !healthy {
+				select {
+				case evicted <- err:
+				default:
+				}
+			}
+		}),
+	); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer CloseXOrmEngineGroup("lag")
+
+	time.Sleep(time.Second)
+	select {
+	case err := <-evicted:
+		t.Errorf("slave one heartbeat behind should not be evicted: %v", err)
+	default:
+	}
+	if lag := XOrmEngineSlaveLags("lag")[0]; lag < 0 || lag > time.Millisecond*200 {
+		t.Errorf("unexpected lag %s", lag)
+	}
+
+	close(stop)
+	<-stopped
+	select {
+	case <-evicted:
+	case <-time.After(time.Second * 2):
+		t.Error("slave not replicating should be evicted")
+	}
+}
+
+func TestXOrmGroupSticky(t *testing.T) {
+	for _, name := range []string{"sticky_master", "sticky_slave"} {
+		if err := InitXOrmEngine(
+			XOrmEngineName(name),
+			XOrmDriver("mysql"),
+			XOrmDataSource("root:root@tcp(127.0.0.1:3306)/test?charset=utf8"),
+		); err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+	}
+	if err := InitXOrmEngineGroup(
+		XOrmGroupName("sticky"),
+		XOrmMaster(XOrmEngine("sticky_master")),
+		XOrmSlave(XOrmEngine("sticky_slave"), 0),
+		XOrmGroupStickyWindow(time.Millisecond*100),
+	); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer CloseXOrmEngineGroup("sticky")
+
+	if XOrmMarkWritten(context.Background(), "sticky") {
+		t.Error("ctx without XOrmStickyContext should not be marked")
+	}
+	ctx := XOrmStickyContext(context.Background())
+	if XOrmIsSticky(ctx, "sticky") {
+		t.Error("ctx should not be sticky before write")
+	}
+	if session := XOrmGroupSQLSession(ctx, "sticky", "UPDATE t SET a = 1"); session == nil {
+		t.Error("session is empty")
+	} else {
+		session.Close()
+	}
+	if !XOrmIsSticky(ctx, "sticky") {
+		t.Error("ctx should be sticky after write")
+	}
+	time.Sleep(time.Millisecond * 150)
+	if XOrmIsSticky(ctx, "sticky") {
+		t.Error("ctx should not be sticky after window")
+	}
+
+	for sql, read := range map[string]bool{
+		"select * from t":                                       true,
+		" (SELECT 1)":                                           true,
+		"SELECT * FROM t FOR UPDATE":                            false,
+		"show tables":                                           true,
+		"INSERT INTO t VALUES (1)":                              false,
+		"delete from t":                                         false,
+		"WITH a AS (SELECT 1) SELECT * FROM a":                  true,
+		"WITH a AS (SELECT id FROM t) UPDATE t SET b = 1":       false,
+		"with a as (select id from t) delete from t where id=1": false,
+		"SELECT update_time FROM t":                             true,
+	} {
+		if ormIsReadSQL(sql) != read {
+			t.Errorf("ormIsReadSQL(%q) should be %v", sql, read)
+		}
+	}
+}
+
+type xOrmStickyBean struct {
+	Id int64
+	A  string
+}
+
+func TestXOrmGroupStickySession(t *testing.T) {
+	dir, err := ioutil.TempDir("", "orm")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"sticky_session_master", "sticky_session_slave"} {
+		if err := InitXOrmEngine(
+			XOrmEngineName(name),
+			XOrmDriver("sqlite3"),
+			XOrmDataSource("file:"+filepath.Join(dir, name)+"?_busy_timeout=5000"),
+			XOrmSync2(&xOrmStickyBean{}),
+		); err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		defer CloseXOrmEngine(name)
+	}
+	if err := InitXOrmEngineGroup(
+		XOrmGroupName("sticky_session"),
+		XOrmMaster(XOrmEngine("sticky_session_master")),
+		XOrmSlave(XOrmEngine("sticky_session_slave"), 0),
+	); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer CloseXOrmEngineGroup("sticky_session")
+	// slave没有复制, 读到1行说明读请求路由到了master
+	count := func(session *xorm.Session) int64 {
+		defer session.Close()
+		n, err := session.Count(&xOrmStickyBean{})
+		if err != nil {
+			t.Error(err)
+		}
+		return n
+	}
+
+	ctx := XOrmStickyContext(context.Background())
+	if count(XOrmGroupSession(ctx, "sticky_session")) != 0 {
+		t.Error("read before write should use the slave")
+	}
+	session := XOrmGroupWriteSession(ctx, "sticky_session")
+	if _, err := session.Insert(&xOrmStickyBean{A: "a"}); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	session.Close()
+	if !XOrmIsSticky(ctx, "sticky_session") {
+		t.Error("ctx should be sticky after the write session")
+	}
+	if count(XOrmGroupSession(ctx, "sticky_session")) != 1 {
+		t.Error("read after write should use the master")
+	}
+	if count(XOrmGroupSession(context.Background(), "sticky_session")) != 0 {
+		t.Error("read with another ctx should use the slave")
+	}
+
+	// 写语句选择master会话并标记ctx
+	ctx = XOrmStickyContext(context.Background())
+	session = XOrmGroupSQLSession(ctx, "sticky_session", "UPDATE x_orm_sticky_bean SET a = 'c'")
+	if _, err := session.Exec("UPDATE x_orm_sticky_bean SET a = 'c'"); err != nil {
+		t.Error(err)
+	}
+	session.Close()
+	if !XOrmIsSticky(ctx, "sticky_session") {
+		t.Error("ctx should be sticky after write sql")
+	}
+	if count(XOrmGroupSQLSession(ctx, "sticky_session", "SELECT * FROM x_orm_sticky_bean")) != 1 {
+		t.Error("read sql after write should use the master")
+	}
+}
+
+func TestXOrmGroupSessionPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "orm")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	// 每个slave中的行数不同, 通过Count判断读请求落到的slave
+	var slaves []*xorm.Engine
+	for i, name := range []string{"session_policy_master", "session_policy_slave1", "session_policy_slave2", "session_policy_slave3"} {
+		if err := InitXOrmEngine(
+			XOrmEngineName(name),
+			XOrmDriver("sqlite3"),
+			XOrmDataSource("file:"+filepath.Join(dir, name)+"?_busy_timeout=5000"),
+			XOrmSync2(&xOrmStickyBean{}),
+		); err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		defer CloseXOrmEngine(name)
+		for n := 0; n < i; n++ {
+			if _, err := XOrmEngine(name).Insert(&xOrmStickyBean{A: name}); err != nil {
+				t.Error(err)
+				t.FailNow()
+			}
+		}
+		if i > 0 {
+			slaves = append(slaves, XOrmEngine(name))
+		}
+	}
+	latency := XOrmLatencyPolicy(0)
+	for group, policy := range map[string]xorm.GroupPolicy{"session_hash": XOrmConsistentHashPolicy(0), "session_latency": latency} {
+		if err := InitXOrmEngineGroup(
+			XOrmGroupName(group),
+			XOrmMaster(XOrmEngine("session_policy_master")),
+			XOrmSlave(slaves[0], 0),
+			XOrmSlave(slaves[1], 0),
+			XOrmSlave(slaves[2], 0),
+			XOrmUsePolicy(policy),
+			XOrmGroupProbeInterval(time.Hour),
+		); err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		defer CloseXOrmEngineGroup(group)
+	}
+
+	for _, key := range []string{"a", "b", "c", "d"} {
+		ctx := XOrmWithHashKey(context.Background(), key)
+		want, err := XOrmEngineSlaveContext(ctx, "session_hash").Count(&xOrmStickyBean{})
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		for i := 0; i < 3; i++ {
+			session := XOrmGroupSession(ctx, "session_hash")
+			if session.DB() != XOrmEngineSlaveContext(ctx, "session_hash").DB() {
+				t.Errorf("key %s session should be opened on the slave chosen by the ctx policy", key)
+			}
+			if n, err := session.Count(&xOrmStickyBean{}); err != nil || n != want {
+				t.Errorf("key %s should always read the same slave, got %d want %d: %v", key, n, want, err)
+			}
+			session.Close()
+		}
+	}
+
+	var beans []xOrmStickyBean
+	if err := XOrmGroupRead(context.Background(), "session_latency", func(session *xorm.Session) error {
+		return session.Find(&beans)
+	}); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if len(beans) == 0 {
+		t.Error("read through the group should use a slave")
+	}
+	p := latency.(*xOrmLatencyPolicy)
+	p.mu.Lock()
+	observed := len(p.ewma)
+	p.mu.Unlock()
+	if observed != 1 {
+		t.Errorf("query latency of the group read should be observed, got %d slaves", observed)
+	}
+}
+
+func TestXOrmGroupPolicy(t *testing.T) {
+	var slaves []*xorm.Engine
+	for i := 0; i < 3; i++ {
+		engine, err := xorm.NewEngine("mysql", fmt.Sprintf("root:root@tcp(127.0.0.1:330%d)/test", i))
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		slaves = append(slaves, engine)
+	}
+	master, _ := xorm.NewEngine("mysql", "root:root@tcp(127.0.0.1:3306)/test")
+
+	latency := XOrmLatencyPolicy(0.5)
+	latency.Observe(slaves[0], time.Millisecond*10)
+	latency.Observe(slaves[1], time.Millisecond)
+	latency.Observe(slaves[2], time.Millisecond*5)
+	if err := InitXOrmEngineGroup(
+		XOrmGroupName("policy_latency"),
+		XOrmMaster(master),
+		XOrmSlave(slaves[0], 0),
+		XOrmSlave(slaves[1], 0),
+		XOrmSlave(slaves[2], 0),
+		XOrmUsePolicy(latency),
+		XOrmGroupProbeInterval(time.Hour),
+	); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if slave := XOrmEngineSlave("policy_latency"); slave != slaves[1] {
+		t.Error("latency policy should pick the fastest slave")
+	}
+	XOrmObserveLatency("policy_latency", slaves[1], time.Millisecond*100)
+	if slave := XOrmEngineSlave("policy_latency"); slave != slaves[2] {
+		t.Error("latency policy should pick the new fastest slave")
+	}
+
+	if err := InitXOrmEngineGroup(
+		XOrmGroupName("policy_zone"),
+		XOrmMaster(master),
+		XOrmSlaveZone(slaves[0], 0, "a"),
+		XOrmSlaveZone(slaves[1], 0, "b"),
+		XOrmSlaveZone(slaves[2], 0, "b"),
+		XOrmUsePolicy(XOrmZoneAffinityPolicy("a")),
+	); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	for i := 0; i < 3; i++ {
+		if slave := XOrmEngineSlave("policy_zone"); slave != slaves[0] {
+			t.Error("zone affinity policy should pick the slave in the same zone")
+		}
+	}
+
+	if err := InitXOrmEngineGroup(
+		XOrmGroupName("policy_hash"),
+		XOrmMaster(master),
+		XOrmSlave(slaves[0], 0),
+		XOrmSlave(slaves[1], 0),
+		XOrmSlave(slaves[2], 0),
+		XOrmUsePolicy(XOrmConsistentHashPolicy(0)),
+	); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	picked := make(map[*xorm.Engine]bool)
+	for i := 0; i < 20; i++ {
+		ctx := XOrmWithHashKey(context.Background(), fmt.Sprintf("user:%d", i))
+		slave := XOrmEngineSlaveContext(ctx, "policy_hash")
+		if XOrmEngineSlaveContext(ctx, "policy_hash") != slave {
+			t.Error("consistent hash policy should pick the same slave for the same key")
+		}
+		picked[slave] = true
+	}
+	if len(picked) < 2 {
+		t.Error("consistent hash policy should spread keys across slaves")
+	}
+
+	for _, name := range []string{"policy_latency", "policy_zone", "policy_hash"} {
+		CloseXOrmEngineGroup(name)
+	}
+}
+
+func TestXOrmGroupAddRemoveSlave(t *testing.T) {
+	drainTimeout := DrainTimeout
+	DrainTimeout = time.Millisecond * 200
+	defer func() { DrainTimeout = drainTimeout }()
+
+	var engines []*xorm.Engine
+	for i := 0; i < 3; i++ {
+		engine, err := xorm.NewEngine("mysql", fmt.Sprintf("root:root@tcp(127.0.0.1:330%d)/test", i))
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		engines = append(engines, engine)
+	}
+	if err := InitXOrmEngineGroup(
+		XOrmGroupName("dynamic"),
+		XOrmMaster(engines[0]),
+		XOrmSlave(engines[1], 1),
+	); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer CloseXOrmEngineGroup("dynamic")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			if XOrmEngineSlave("dynamic") == nil {
+				t.Error("XOrmEngineSlave is empty")
+				return
+			}
+		}
+	}()
+	if err := XOrmGroupAddSlave("dynamic", engines[2], 2); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if err := XOrmGroupAddSlave("dynamic", engines[2], 2); err == nil {
+		t.Error("adding an existing slave should return error")
+	}
+	if slaves := XOrmEngineHealthySlaves("dynamic"); len(slaves) != 2 {
+		t.Errorf("expected 2 slaves after add, got %d", len(slaves))
+	}
+	if err := XOrmGroupRemoveSlave("dynamic", engines[1]); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	<-done
+	if slaves := XOrmEngineSlaves("dynamic"); len(slaves) != 1 || slaves[0] != engines[2] {
+		t.Error("removed slave is still in the group")
+	}
+	for i := 0; i < 3; i++ {
+		if XOrmEngineSlave("dynamic") != engines[2] {
+			t.Error("XOrmEngineSlave should return the remaining slave")
+		}
+	}
+	time.Sleep(DrainTimeout * 2)
+	if err := engines[1].DB().Ping(); err == nil || err.Error() != "sql: database is closed" {
+		t.Errorf("removed slave should be closed after drain, got: %v", err)
+	}
+}
+
+// 使用-race运行, 增删slave与分组上的查询并发
+func TestXOrmGroupAddRemoveSlaveRace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "orm")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	// 每个engine中的行数不同, 通过Count判断读请求落到的engine
+	var engines []*xorm.Engine
+	for i, name := range []string{"race_master", "race_slave1", "race_slave2", "race_slave3"} {
+		if err := InitXOrmEngine(
+			XOrmEngineName(name),
+			XOrmDriver("sqlite3"),
+			XOrmDataSource("file:"+filepath.Join(dir, name)+"?_busy_timeout=5000"),
+			XOrmSync2(&xOrmStickyBean{}),
+		); err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		defer CloseXOrmEngine(name)
+		for n := 0; n < i; n++ {
+			if _, err := XOrmEngine(name).Insert(&xOrmStickyBean{A: name}); err != nil {
+				t.Error(err)
+				t.FailNow()
+			}
+		}
+		engines = append(engines, XOrmEngine(name))
+	}
+	if err := InitXOrmEngineGroup(
+		XOrmGroupName("race"),
+		XOrmMaster(engines[0]),
+		XOrmSlave(engines[1], 0),
+	); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer CloseXOrmEngineGroup("race")
+
+	// 读请求固定执行200次, 期间不断增删slave, 始终保留至少一个slave, 读请求不应路由到master
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 200; n++ {
+				session := XOrmEngineGroup("race").NewSession()
+				count, err := session.Count(&xOrmStickyBean{})
+				session.Close()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if count < 1 || count > 3 {
+					t.Errorf("read routed to master, count %d", count)
+					return
+				}
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+loop:
+	for i := 0; ; i++ {
+		select {
+		case <-done:
+			break loop
+		default:
+		}
+		for _, err := range []error{
+			XOrmGroupAddSlave("race", engines[2], i%3),
+			XOrmGroupAddSlave("race", engines[3], 0),
+			XOrmGroupRemoveSlave("race", engines[1]),
+			XOrmGroupAddSlave("race", engines[1], 1),
+			XOrmGroupRemoveSlave("race", engines[2]),
+			XOrmGroupRemoveSlave("race", engines[3]),
+		} {
+			if err != nil {
+				t.Error(err)
+			}
+		}
+	}
+	if slaves := XOrmEngineHealthySlaves("race"); len(slaves) != 1 || slaves[0] != engines[1] {
+		t.Error("unexpected slaves after add/remove")
+	}
+}
+
+// 测试用的内存core.Cacher
+type xOrmMapCache map[string]interface{}
+
+func (c xOrmMapCache) GetIds(tableName, sql string) interface{} { return c["ids:"+tableName+":"+sql] }
+func (c xOrmMapCache) GetBean(tableName string, id string) interface{} {
+	return c["bean:"+tableName+":"+id]
+}
+func (c xOrmMapCache) PutIds(tableName, sql string, ids interface{}) {
+	c["ids:"+tableName+":"+sql] = ids
+}
+func (c xOrmMapCache) PutBean(tableName string, id string, obj interface{}) {
+	c["bean:"+tableName+":"+id] = obj
+}
+func (c xOrmMapCache) DelIds(tableName, sql string)        { delete(c, "ids:"+tableName+":"+sql) }
+func (c xOrmMapCache) DelBean(tableName string, id string) { delete(c, "bean:"+tableName+":"+id) }
+func (c xOrmMapCache) ClearIds(tableName string)           { c.clear("ids:" + tableName + ":") }
+func (c xOrmMapCache) ClearBeans(tableName string)         { c.clear("bean:" + tableName + ":") }
+func (c xOrmMapCache) clear(prefix string) {
+	for key := range c {
+		if strings.HasPrefix(key, prefix) {
+			delete(c, key)
+		}
+	}
+}
+
+// 可以被总线的接收协程并发访问的xOrmMapCache
+type xOrmSyncMapCache struct {
+	mu sync.Mutex
+	m  xOrmMapCache
+}
+
+func (c *xOrmSyncMapCache) do(fn func(m xOrmMapCache) interface{}) interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return fn(c.m)
+}
+func (c *xOrmSyncMapCache) GetIds(tableName, sql string) interface{} {
+	return c.do(func(m xOrmMapCache) interface{} { return m.GetIds(tableName, sql) })
+}
+func (c *xOrmSyncMapCache) GetBean(tableName string, id string) interface{} {
+	return c.do(func(m xOrmMapCache) interface{} { return m.GetBean(tableName, id) })
+}
+func (c *xOrmSyncMapCache) PutIds(tableName, sql string, ids interface{}) {
+	c.do(func(m xOrmMapCache) interface{} { m.PutIds(tableName, sql, ids); return nil })
+}
+func (c *xOrmSyncMapCache) PutBean(tableName string, id string, obj interface{}) {
+	c.do(func(m xOrmMapCache) interface{} { m.PutBean(tableName, id, obj); return nil })
+}
+func (c *xOrmSyncMapCache) DelIds(tableName, sql string) {
+	c.do(func(m xOrmMapCache) interface{} { m.DelIds(tableName, sql); return nil })
+}
+func (c *xOrmSyncMapCache) DelBean(tableName string, id string) {
+	c.do(func(m xOrmMapCache) interface{} { m.DelBean(tableName, id); return nil })
+}
+func (c *xOrmSyncMapCache) ClearIds(tableName string) {
+	c.do(func(m xOrmMapCache) interface{} { m.ClearIds(tableName); return nil })
+}
+func (c *xOrmSyncMapCache) ClearBeans(tableName string) {
+	c.do(func(m xOrmMapCache) interface{} { m.ClearBeans(tableName); return nil })
+}
+
+func TestXOrmTwoTierCache(t *testing.T) {
+	remote := xOrmMapCache{}
+	cache := NewXOrmTwoTierCache(remote, 2, time.Millisecond*50)
+	cache.PutBean("bean", "1", "a")
+	cache.PutBean("bean", "2", "b")
+	cache.PutIds("bean", "select id", []int64{1, 2})
+	if cache.local.len() != 2 {
+		t.Errorf("local size %d, want 2", cache.local.len())
+		t.FailNow()
+	}
+	if bean := cache.GetBean("bean", "1"); bean != "a" { // 被淘汰后从remote读取并回填
+		t.Errorf("bean %v, want a", bean)
+		t.FailNow()
+	}
+	cache.ClearBeans("bean")
+	if cache.GetBean("bean", "1") != nil || remote.GetBean("bean", "1") != nil {
+		t.Error("bean not cleared")
+		t.FailNow()
+	}
+	if cache.GetIds("bean", "select id") == nil {
+		t.Error("ids cleared by ClearBeans")
+		t.FailNow()
+	}
+	cache.ClearIds("bean")
+	if cache.GetIds("bean", "select id") != nil || remote.GetIds("bean", "select id") != nil {
+		t.Error("ids not cleared")
+		t.FailNow()
+	}
+	cache.PutBean("bean", "3", "c")
+	remote.DelBean("bean", "3")
+	if cache.GetBean("bean", "3") != "c" {
+		t.Error("local tier miss")
+		t.FailNow()
+	}
+	time.Sleep(time.Millisecond * 60)
+	if cache.GetBean("bean", "3") != nil {
+		t.Error("local tier not expired")
+		t.FailNow()
+	}
+}
+
+func TestXOrmCacheBusApply(t *testing.T) {
+	bus := &xOrmCacheBus{id: xOrmBusInstanceID(), tables: make(map[string]struct{})}
+	remote, lru := xOrmMapCache{}, xOrmMapCache{}
+	twoTier := NewXOrmTwoTierCache(remote, 10, 0)
+	bus.Attach(twoTier, lru)
+	twoTier.PutBean("bean", "1", "a")
+	twoTier.PutIds("bean", "select id", []int64{1})
+	lru.PutBean("bean", "1", "a")
+	lru.PutBean("other", "1", "b")
+
+	bus.apply(&xOrmBusMessage{Op: xOrmBusDelBean, Table: "bean", Key: "1"})
+	if twoTier.local.get(xOrmLocalKey{kind: xOrmLocalBean, table: "bean", key: "1"}) != nil || lru.GetBean("bean", "1") != nil {
+		t.Error("bean not invalidated")
+		t.FailNow()
+	}
+	if remote.GetBean("bean", "1") == nil {
+		t.Error("remote tier should not be invalidated by subscriber")
+		t.FailNow()
+	}
+	bus.addTable("other")
+	bus.apply(&xOrmBusMessage{Op: xOrmBusFlush})
+	if twoTier.local.len() != 0 || len(lru) != 0 {
+		t.Errorf("flush left %d local, %d lru entries", twoTier.local.len(), len(lru))
+		t.FailNow()
+	}
+}
+
+func TestXOrmCacheBusReceive(t *testing.T) {
+	s, client := redistest.New(t)
+	cache, err := NewXOrmRedisCacheClient(client, time.Minute)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	a, b := NewXOrmCacheBus(cache, ""), NewXOrmCacheBus(cache, "")
+	defer a.Close()
+	defer b.Close()
+	local := &xOrmSyncMapCache{m: xOrmMapCache{}}
+	cacherA, cacherB := a.Cacher(local), b.Cacher(&xOrmSyncMapCache{m: xOrmMapCache{}})
+	wait := func(timeout time.Duration, cond func() bool) bool {
+		for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(time.Millisecond * 10) {
+			if cond() {
+				return true
+			}
+		}
+		return false
+	}
+
+	// 订阅是异步建立的, 重复发布直到收到通知
+	if !wait(time.Second, func() bool {
+		cacherA.PutBean("bean", "1", "a")
+		cacherB.DelBean("bean", "1")
+		time.Sleep(time.Millisecond * 10)
+		return local.GetBean("bean", "1") == nil
+	}) {
+		t.Error("invalidation from the other instance not received")
+		t.FailNow()
+	}
+
+	// 只写入过没有收发过通知的表也要在重连后清除
+	cacherA.PutBean("bean", "2", "b")
+	cacherA.PutIds("other", "select id", []int64{1})
+	s.Close()
+	time.Sleep(time.Millisecond * 50)
+	if err := s.Restart(); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if !wait(time.Second*5, func() bool {
+		return local.GetBean("bean", "2") == nil && local.GetIds("other", "select id") == nil
+	}) {
+		t.Error("local caches not flushed after resubscribe")
+		t.FailNow()
+	}
+}
+
+func TestXOrmRedisCacheCodec(t *testing.T) {
+	bean := &xOrmTestBean{ID: 1, A: "a", B: 1.5, C: true, D: Slice{"x", "y"}, V: 2}
+	for name, codec := range map[string]XOrmCacheCodec{"gob": XOrmCacheGobCodec, "json": XOrmCacheJSONCodec, "msgpack": XOrmCacheMsgpackCodec} {
+		for _, value := range []interface{}{bean, []*xOrmTestBean{bean}, "ids"} {
+			bs, err := codecMarshal(codec, value)
+			if err != nil {
+				t.Errorf("%s marshal %T error: %v", name, value, err)
+				t.FailNow()
+			}
+			got, err := codecUnmarshal(codec, bs)
+			if err != nil {
+				t.Errorf("%s unmarshal %T error: %v", name, value, err)
+				t.FailNow()
+			}
+			if !reflect.DeepEqual(got, value) {
+				t.Errorf("%s got %#v, want %#v", name, got, value)
+				t.FailNow()
+			}
+		}
+	}
+	type unknown struct{ A int }
+	bs, err := codecMarshal(XOrmCacheGobCodec, unknown{A: 1})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	codecTypes.Delete(codecTypeName(reflect.TypeOf(unknown{})))
+	if _, err := codecUnmarshal(XOrmCacheGobCodec, bs); err != errCodecUnknownType {
+		t.Errorf("unknown type error %v", err)
+		t.FailNow()
+	}
+}
+
+type xOrmCodecBean struct {
+	ID int64
+	A  string
+}
+
+func TestXOrmRedisCacheRegisterType(t *testing.T) {
+	_, client := redistest.New(t)
+	var logs bytes.Buffer
+	cache, err := NewXOrmRedisCacheClient(client, time.Minute, XOrmRedisCacheLogger(log.New(&logs, "", 0)))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	// 其他进程写入的值, 本进程没有编码过该类型
+	bean := &xOrmCodecBean{ID: 1, A: "a"}
+	bs, err := codecMarshal(XOrmCacheGobCodec, bean)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	codecTypes.Delete(codecTypeName(reflect.TypeOf(bean)))
+	codecTypes.Delete(codecTypeName(reflect.TypeOf(*bean)))
+	client.Set(cache.beanKey("bean", "1"), bs, 0)
+	if cache.GetBean("bean", "1") != nil {
+		t.Error("unregistered type should be a miss")
+		t.FailNow()
+	}
+	XOrmRegisterCacheType(xOrmCodecBean{})
+	if got := cache.GetBean("bean", "1"); !reflect.DeepEqual(got, bean) {
+		t.Errorf("registered type got %#v, want %#v", got, bean)
+		t.FailNow()
+	}
+
+	// 旧版本直接gob编码的值
+	var old bytes.Buffer
+	if err := gob.NewEncoder(&old).Encode(bean); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	client.Set(cache.beanKey("bean", "2"), old.Bytes(), 0)
+	if cache.GetBean("bean", "2") != nil {
+		t.Error("old payload should be a miss")
+		t.FailNow()
+	}
+	if logs.Len() != 0 {
+		t.Errorf("misses should not be logged: %s", logs.String())
+	}
+}
+
+func TestXOrmRedisCacheKey(t *testing.T) {
+	v1, v2 := &xOrmRedisCache{version: "v1"}, &xOrmRedisCache{version: "v2"}
+	sql := core.GenSqlKey("SELECT id FROM bean WHERE a = ?", []interface{}{1})
+	if v1.sqlKey("bean", sql) == v1.sqlKey("bean", core.GenSqlKey("SELECT id FROM bean WHERE a = ?", []interface{}{2})) {
+		t.Error("args not in key")
+		t.FailNow()
+	}
+	if v1.sqlKey("bean", sql) == v2.sqlKey("bean", sql) {
+		t.Error("version not in key")
+		t.FailNow()
+	}
+	if key := v1.beanKey("bean", "1"); len(key) != len("xorm:bean:bean:")+32 {
+		t.Errorf("bean key %s", key)
+		t.FailNow()
+	}
+	original, payload, err := xOrmCacheUnwrapOriginal(xOrmCacheWrapOriginal(sql, []byte("payload")))
+	if err != nil || original != sql || string(payload) != "payload" {
+		t.Errorf("unwrap %q %q %v", original, payload, err)
+		t.FailNow()
+	}
+	if _, _, err := xOrmCacheUnwrapOriginal([]byte{0xff}); err == nil {
+		t.Error("invalid payload unwrapped")
+		t.FailNow()
+	}
+}
+
+func TestXOrmRedisCacheStampede(t *testing.T) {
+	c := &xOrmRedisCache{flightWait: time.Second, flights: make(map[string]*xOrmCacheFlight)}
+	if c.miss("table", "key", "1") != nil {
+		t.Error("leader should query database")
+		t.FailNow()
+	}
+	results := make(chan interface{}, 3)
+	for i := 0; i < 3; i++ {
+		go func() { results <- c.miss("table", "key", "1") }()
+	}
+	time.Sleep(time.Millisecond * 50)
+	if c.flightDelta("key") <= 0 {
+		t.Error("flight not started")
+		t.FailNow()
+	}
+	c.finish("key", nil, "bean")
+	for i := 0; i < 3; i++ {
+		if value := <-results; value != "bean" {
+			t.Errorf("follower got %v", value)
+			t.FailNow()
+		}
+	}
+	if c.flightDelta("key") != 0 {
+		t.Error("flight not finished")
+		t.FailNow()
+	}
+
+	now := time.Now()
+	expireAt, delta, payload, err := xOrmCacheUnwrapXFetch(xOrmCacheWrapXFetch(now, time.Second, []byte("payload")))
+	if err != nil || !expireAt.Equal(time.Unix(0, now.UnixNano())) || delta != time.Second || string(payload) != "payload" {
+		t.Errorf("unwrap %v %v %q %v", expireAt, delta, payload, err)
+		t.FailNow()
+	}
+	if xOrmCacheXFetchExpired(now, now.Add(time.Hour), time.Millisecond, 1) {
+		t.Error("expired too early")
+		t.FailNow()
+	}
+	if !xOrmCacheXFetchExpired(now, now, time.Millisecond, 1) {
+		t.Error("not expired at expiry")
+		t.FailNow()
+	}
+}
+
+func TestXOrmRedisCacheStampedeRemote(t *testing.T) {
+	_, client := redistest.New(t)
+	var caches []*xOrmRedisCache
+	for i := 0; i < 2; i++ {
+		cache, err := NewXOrmRedisCacheClient(client, time.Minute, XOrmRedisCacheLock(time.Second*2), XOrmRedisCacheXFetch(1))
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		// 未命中后查询20ms写入, 记录表的查询耗时
+		sql := fmt.Sprintf("select id %d", i)
+		if cache.GetIds("bean", sql) != nil {
+			t.Error("ids should miss")
+			t.FailNow()
+		}
+		time.Sleep(time.Millisecond * 20)
+		cache.PutIds("bean", sql, []int64{1})
+		caches = append(caches, cache)
+	}
+	a, b := caches[0], caches[1]
+
+	// 没有flight的写入使用表最近的耗时
+	a.PutBean("bean", "1", "bean")
+	bs, err := client.Get(a.beanKey("bean", "1")).Bytes()
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if _, delta, _, _ := xOrmCacheUnwrapXFetch(bs); delta < time.Millisecond*20 {
+		t.Errorf("xfetch delta %v without a flight", delta)
+	}
+
+	// a持有锁但查不到记录, b不需要等到锁过期
+	if a.GetBean("bean", "2") != nil {
+		t.Error("bean should miss")
+		t.FailNow()
+	}
+	start := time.Now()
+	if b.GetBean("bean", "2") != nil {
+		t.Error("bean should miss")
+		t.FailNow()
+	}
+	if wait := time.Since(start); wait > time.Second {
+		t.Errorf("waited %v for a not found bean", wait)
+	}
+}
+
+func TestXOrmRedisCacheNegative(t *testing.T) {
+	if !xOrmCacheIsEmptyIds(xOrmCacheEmptyIds) {
+		t.Error("empty ids not detected")
+		t.FailNow()
+	}
+	ids := []core.PK{{int64(1)}}
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(ids); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if xOrmCacheIsEmptyIds(buffer.String()) || xOrmCacheIsEmptyIds(&xOrmTestBean{}) {
+		t.Error("non-empty value detected as empty ids")
+		t.FailNow()
+	}
+	if _, err := codecUnmarshal(XOrmCacheGobCodec, xOrmCacheNegativeSentinel); err == nil {
+		t.Error("sentinel decoded as value")
+		t.FailNow()
+	}
+
+	c := &xOrmRedisCache{blooms: map[string]*xOrmBloomFilter{"bean": newXOrmBloomFilter(1000, 0.01)}}
+	for i := int64(0); i < 1000; i++ {
+		c.BloomAdd("bean", i)
+	}
+	falsePositives := 0
+	for i := int64(0); i < 2000; i++ {
+		exist := c.MayExist("bean", i)
+		if i < 1000 && !exist {
+			t.Errorf("pk %d not found", i)
+			t.FailNow()
+		}
+		if i >= 1000 && exist {
+			falsePositives++
+		}
+	}
+	if falsePositives > 50 {
+		t.Errorf("%d false positives", falsePositives)
+		t.FailNow()
+	}
+	if !c.MayExist("other", 1) {
+		t.Error("table without bloom filter")
+		t.FailNow()
+	}
+	c.BloomAdd("bean"+xOrmCacheTenantSep+"tenant", int64(5000))
+	if !c.MayExist("bean", int64(5000)) || c.MayExist("bean"+xOrmCacheTenantSep+"tenant", int64(6000)) {
+		t.Error("tenant table not sharing bloom filter of base table")
+		t.FailNow()
+	}
+
+	s, client := redistest.New(t)
+	cache, err := NewXOrmRedisCacheClient(client, time.Minute,
+		XOrmRedisCacheNegative(time.Second*10), XOrmRedisCacheBloomFilter("bean", 1000, 0.01))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	cache.PutIds("bean", "select id where a = 1", xOrmCacheEmptyIds)
+	if !s.Exists(cache.sqlKey("bean", "select id where a = 1")) {
+		t.Error("empty ids not cached")
+		t.FailNow()
+	}
+	// 填充缓存不会清除空结果, 写操作才会
+	cache.PutBean("bean", "1", "bean")
+	if got := cache.GetIds("bean", "select id where a = 1"); got != xOrmCacheEmptyIds {
+		t.Errorf("empty ids cleared by PutBean, got %v", got)
+		t.FailNow()
+	}
+	cache.DelBean("bean", "1")
+	if cache.GetIds("bean", "select id where a = 1") != nil {
+		t.Error("empty ids not cleared by DelBean")
+		t.FailNow()
+	}
+	cache.PutIds("bean", "select id where a = 1", xOrmCacheEmptyIds)
+	cache.ClearBeans("bean")
+	if cache.GetIds("bean", "select id where a = 1") != nil {
+		t.Error("empty ids not cleared by ClearBeans")
+		t.FailNow()
+	}
+
+	// 不在布隆过滤器中的主键不访问redis
+	client.Set(cache.beanKey("bean", "2"), "stale", 0)
+	if cache.GetBean("bean", "2") != nil {
+		t.Error("bean not in the bloom filter should miss")
+		t.FailNow()
+	}
+	cache.PutBean("bean", "2", "bean")
+	if cache.GetBean("bean", "2") != "bean" {
+		t.Error("bean in the bloom filter should hit")
+		t.FailNow()
+	}
+}
+
+func TestXOrmRedisCacheTTL(t *testing.T) {
+	opts := &xOrmRedisCacheOption{}
+	for _, option := range []XOrmRedisCacheOption{
+		XOrmRedisCacheIdsTTL(time.Minute),
+		XOrmRedisCacheTableTTL("config", time.Hour, 0),
+		XOrmRedisCacheTableTTL("hot", 0, time.Second),
+	} {
+		option(opts)
+	}
+	c := &xOrmRedisCache{expiration: time.Minute * 10, idsTTL: opts.idsTTL, tableTTLs: opts.tableTTLs}
+	for _, test := range []struct {
+		table string
+		ids   bool
+		want  time.Duration
+	}{
+		{"bean", false, time.Minute * 10},
+		{"bean", true, time.Minute},
+		{"config", false, time.Hour},
+		{"config", true, time.Minute},
+		{"hot", false, time.Minute * 10},
+		{"hot", true, time.Second},
+	} {
+		if ttl := c.ttl(test.table, test.ids); ttl != test.want {
+			t.Errorf("%s ids=%v ttl %s, want %s", test.table, test.ids, ttl, test.want)
+			t.FailNow()
+		}
+	}
+	c.jitter = 0.1
+	for i := 0; i < 100; i++ {
+		if ttl := c.ttl("bean", false); ttl < time.Minute*10 || ttl >= time.Minute*11 {
+			t.Errorf("jitter ttl %s", ttl)
+			t.FailNow()
+		}
+	}
+	if expireAt, _, _, _ := xOrmCacheUnwrapXFetch(xOrmCacheWrapXFetch(time.Time{}, 0, nil)); !expireAt.IsZero() {
+		t.Error("no expiration")
+		t.FailNow()
+	}
+}
+
+func TestXOrmRedisCacheBreaker(t *testing.T) {
+	if _, err := NewXOrmRedisCache([]string{"127.0.0.1:1"}, "", 0, time.Minute, XOrmRedisCacheTimeout(time.Millisecond*100)); err == nil {
+		t.Error("unreachable redis without error")
+		t.FailNow()
+	}
+
+	var b *xOrmCacheBreaker
+	if !b.allow() {
+		t.Error("nil breaker should allow")
+		t.FailNow()
+	}
+	b = newXOrmCacheBreaker("test", xOrmStdLogger{}, 2, time.Millisecond*50)
+	b.report(errors.New("timeout"))
+	b.report(redis.Nil)
+	b.report(errors.New("timeout"))
+	if !b.allow() {
+		t.Error("redis.Nil should reset failures")
+		t.FailNow()
+	}
+	b.report(errors.New("timeout"))
+	if b.allow() || !b.open() {
+		t.Error("breaker not open")
+		t.FailNow()
+	}
+	time.Sleep(time.Millisecond * 60)
+	if !b.allow() || b.allow() {
+		t.Error("half open should allow exactly one probe")
+		t.FailNow()
+	}
+	b.report(errors.New("timeout"))
+	if b.allow() {
+		t.Error("failed probe should reopen")
+		t.FailNow()
+	}
+	time.Sleep(time.Millisecond * 60)
+	if !b.allow() {
+		t.Error("probe not allowed")
+		t.FailNow()
+	}
+	b.report(nil)
+	if !b.allow() || b.open() {
+		t.Error("breaker not recovered")
+		t.FailNow()
+	}
+
+	// 探测请求没有发出redis命令时不能一直占用探测
+	b.report(errors.New("timeout"))
+	b.report(errors.New("timeout"))
+	time.Sleep(time.Millisecond * 60)
+	if !b.allow() || b.allow() {
+		t.Error("half open should allow exactly one probe")
+		t.FailNow()
+	}
+	time.Sleep(time.Millisecond * 60)
+	if !b.allow() {
+		t.Error("probe without redis command should expire")
+		t.FailNow()
+	}
+}
+
+// 熔断只统计cache自己的client副本, 熔断期间的删除在恢复后重放
+func TestXOrmRedisCacheBreakerReplay(t *testing.T) {
+	s, client := redistest.New(t)
+	cache, err := NewXOrmRedisCacheClient(client, time.Minute, XOrmRedisCacheBreaker(1, time.Millisecond*50))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer xOrmRedisCaches.Delete(cache)
+	cache.PutBean("bean", "1", "a")
+	cache.PutIds("bean", "select id", []int64{1})
+	beanKey, sqlKey := cache.beanKey("bean", "1"), cache.sqlKey("bean", "select id")
+	if !s.Exists(beanKey) || !s.Exists(sqlKey) {
+		t.Error("put failed")
+		t.FailNow()
+	}
+
+	s.Close()
+	if client.Get("other").Err() == nil || cache.breaker.open() {
+		t.Error("commands of the caller's client should not open the breaker")
+		t.FailNow()
+	}
+	cache.DelBean("bean", "1")
+	if !cache.breaker.open() {
+		t.Error("breaker not open")
+		t.FailNow()
+	}
+	cache.DelIds("bean", "select id")
+	if err := s.Restart(); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if cache.GetBean("bean", "1") != nil || !s.Exists(beanKey) {
+		t.Error("open breaker should not access redis")
+		t.FailNow()
+	}
+	for deadline := time.Now().Add(time.Second * 2); time.Now().Before(deadline); time.Sleep(time.Millisecond * 60) {
+		if cache.GetBean("bean", "1") == nil && !s.Exists(beanKey) && !s.Exists(sqlKey) {
+			break
+		}
+	}
+	if s.Exists(beanKey) || s.Exists(sqlKey) || cache.breaker.open() {
+		t.Errorf("invalidations not replayed: %v", s.Keys())
+		t.FailNow()
+	}
+	cache.PutBean("bean", "1", "b")
+	if value := cache.GetBean("bean", "1"); value != "b" {
+		t.Errorf("get after recovery %v", value)
+		t.FailNow()
+	}
+}
+
+// 读取时按slow阻塞的连接
+type xOrmSlowConn struct {
+	net.Conn
+	slow *int32
+}
+
+func (c *xOrmSlowConn) Read(b []byte) (int, error) {
+	if atomic.LoadInt32(c.slow) == 1 {
+		time.Sleep(time.Millisecond * 300)
+	}
+	return c.Conn.Read(b)
+}
+
+func TestXOrmRedisCacheTimeout(t *testing.T) {
+	s, _ := redistest.New(t)
+	var slow int32
+	client := redis.NewClient(&redis.Options{Addr: s.Addr(), Dialer: func() (net.Conn, error) {
+		conn, err := net.Dial("tcp", s.Addr())
+		if err != nil {
+			return nil, err
+		}
+		return &xOrmSlowConn{Conn: conn, slow: &slow}, nil
+	}})
+	cache, err := NewXOrmRedisCacheClient(client, time.Minute, XOrmRedisCacheTimeout(time.Millisecond*50))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer cache.Close()
+	cache.PutBean("bean", "1", "a")
+
+	atomic.StoreInt32(&slow, 1)
+	start := time.Now()
+	if value := cache.GetBean("bean", "1"); value != nil {
+		t.Errorf("slow get should time out, got %v", value)
+		t.FailNow()
+	}
+	if elapsed := time.Since(start); elapsed > time.Millisecond*200 {
+		t.Errorf("get waited %s", elapsed)
+		t.FailNow()
+	}
+	if stats := cache.Stats()["bean"]; stats.Errors != 1 {
+		t.Errorf("stats %+v", stats)
+		t.FailNow()
+	}
+
+	// 超时的删除在恢复后重放
+	cache.DelBean("bean", "1")
+	atomic.StoreInt32(&slow, 0)
+	time.Sleep(time.Millisecond * 400)
+	cache.PutIds("bean", "select id", []int64{1})
+	if cache.GetBean("bean", "1") != nil || s.Exists(cache.beanKey("bean", "1")) {
+		t.Error("timed out delete not replayed")
+		t.FailNow()
+	}
+}
+
+type xOrmTestLogger struct{ lines []string }
+
+func (l *xOrmTestLogger) Printf(format string, v ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func TestXOrmRedisCacheMetrics(t *testing.T) {
+	logger := &xOrmTestLogger{}
+	c := &xOrmRedisCache{logger: logger, metrics: newXOrmCacheMetrics(nil)}
+	c.metrics.count("user", XOrmCacheHit)
+	c.metrics.count("user", XOrmCacheHit)
+	c.metrics.count("user", XOrmCacheHit)
+	c.metrics.count("user", XOrmCacheMiss)
+	c.metrics.bytes("user", "read", 100)
+	c.metrics.bytes("user", "write", 40)
+	c.metrics.latency("user", "GetBean", time.Now().Add(-time.Millisecond))
+	c.error("user", "GetBean", errors.New("timeout"))
+
+	stats := c.Stats()["user"]
+	if stats.Hits != 3 || stats.Misses != 1 || stats.Errors != 1 || stats.HitRate() != 0.75 {
+		t.Errorf("stats %+v", stats)
+		t.FailNow()
+	}
+	if stats.BytesRead != 100 || stats.BytesWritten != 40 || stats.Ops != 1 || stats.MaxLatency < time.Millisecond {
+		t.Errorf("stats %+v", stats)
+		t.FailNow()
+	}
+	if len(logger.lines) != 1 || !strings.Contains(logger.lines[0], "<GetBean>") {
+		t.Errorf("logger %v", logger.lines)
+		t.FailNow()
+	}
+}
+
+func TestXOrmRedisCacheCompression(t *testing.T) {
+	bean := &xOrmTestBean{ID: 1, A: String(strings.Repeat("text column ", 200))}
+	plain := &xOrmRedisCache{codec: XOrmCacheGobCodec}
+	old, err := plain.serialize("bean", bean)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	for _, compression := range []XOrmCacheCompression{XOrmCacheSnappy, XOrmCacheZstd, XOrmCacheGzip} {
+		c := &xOrmRedisCache{codec: XOrmCacheGobCodec, compression: compression, threshold: 1024, metrics: newXOrmCacheMetrics(nil)}
+		bs, err := c.serialize("bean", bean)
+		if err != nil {
+			t.Errorf("%s compress error: %v", compression, err)
+			t.FailNow()
+		}
+		if bs[0] != xOrmCacheCompressedMark || XOrmCacheCompression(bs[1]) != compression || len(bs) >= len(old) {
+			t.Errorf("%s not compressed, %d >= %d", compression, len(bs), len(old))
+			t.FailNow()
+		}
+		for _, payload := range [][]byte{bs, old} { // 压缩与未压缩的值都可以读取
+			got, err := c.deserialize(payload)
+			if err != nil || !reflect.DeepEqual(got, bean) {
+				t.Errorf("%s got %v, %v", compression, got, err)
+				t.FailNow()
+			}
+		}
+		if got, err := plain.deserialize(bs); err != nil || !reflect.DeepEqual(got, bean) {
+			t.Errorf("%s not readable after disable: %v", compression, err)
+			t.FailNow()
+		}
+		small, err := c.serialize("bean", "ids")
+		if err != nil || small[0] == xOrmCacheCompressedMark {
+			t.Errorf("%s value under threshold compressed", compression)
+			t.FailNow()
+		}
+		stats := c.Stats()["bean"]
+		if stats.Compressed != 1 || stats.RawBytes != int64(len(old)) || stats.CompressionRatio() <= 0 || stats.CompressionRatio() >= 1 {
+			t.Errorf("%s stats %+v", compression, stats)
+			t.FailNow()
+		}
+	}
+	if _, err := xOrmCacheDecompress([]byte{xOrmCacheCompressedMark, 9, 1}); err == nil {
+		t.Error("unknown compression decoded")
+		t.FailNow()
+	}
+}
+
+func TestXOrmRedisCacheNamespace(t *testing.T) {
+	c := &xOrmRedisCache{namespace: "svc", tableTTLs: map[string]xOrmCacheTTL{"bean": {bean: time.Hour}}}
+	if key := c.beanKey("bean", "*"); key != "svc:xorm:bean:bean:*" {
+		t.Errorf("bean key %s", key)
+		t.FailNow()
+	}
+	if key := c.negativeKey("bean"); key != "svc:xorm:negative:bean" {
+		t.Errorf("negative key %s", key)
+		t.FailNow()
+	}
+	if c.ttl("bean@t1", false) != time.Hour {
+		t.Error("table ttl not applied to tenant")
+		t.FailNow()
+	}
+	c.metrics = newXOrmCacheMetrics(nil)
+	c.metrics.count("bean@t1", XOrmCacheHit)
+	c.metrics.count("bean@t2", XOrmCacheHit)
+	if stats := c.Stats(); len(stats) != 1 || stats["bean"].Hits != 2 {
+		t.Errorf("tenant metrics should use the base table, got %v", stats)
+		t.FailNow()
+	}
+
+	remote := xOrmMapCache{}
+	if XOrmCacheTenant(remote, "") == nil {
+		t.Error("nil cacher without tenant")
+		t.FailNow()
+	}
+	t1 := XOrmCacheTenant(remote, "t1")
+	t2 := XOrmCacheTenant(remote, "t2")
+	t1.PutBean("bean", "1", "a")
+	t2.PutBean("bean", "1", "b")
+	remote.PutBean("bean", "1", "c")
+	if t1.GetBean("bean", "1") != "a" || t2.GetBean("bean", "1") != "b" {
+		t.Error("tenants not isolated")
+		t.FailNow()
+	}
+	t1.ClearBeans("bean")
+	if t1.GetBean("bean", "1") != nil || t2.GetBean("bean", "1") != "b" || remote.GetBean("bean", "1") != "c" {
+		t.Error("clear leaked to other tenants")
+		t.FailNow()
+	}
+	if xOrmCacheBaseTable("bean@t1") != "bean" {
+		t.Error("tenant base table")
+		t.FailNow()
+	}
+}
+
+// 两个租户的engine共用一个redis cacher, 表名以及主键相同
+func TestXOrmRedisCacheTenants(t *testing.T) {
+	s, client := redistest.New(t)
+	cache, err := NewXOrmRedisCacheClient(client, time.Minute)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer xOrmRedisCaches.Delete(cache)
+	dir, err := ioutil.TempDir("", "orm")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	tenants := []string{"t1", "t2"}
+	for _, tenant := range tenants {
+		name := "tenant_" + tenant
+		if err := InitXOrmEngine(
+			XOrmEngineName(name),
+			XOrmDriver("sqlite3"),
+			XOrmDataSource("file:"+filepath.Join(dir, name)+"?_busy_timeout=5000"),
+			XOrmSync2(&xOrmStickyBean{}),
+			XOrmDefaultCache(XOrmCacheTenant(cache, tenant)),
+		); err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		defer CloseXOrmEngine(name)
+		if _, err := XOrmEngine(name).Insert(&xOrmStickyBean{A: tenant}); err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+	}
+	get := func(tenant string) string {
+		var bean xOrmStickyBean
+		if has, err := XOrmEngine("tenant_" + tenant).ID(1).Get(&bean); err != nil || !has {
+			t.Errorf("get %s: %v %v", tenant, has, err)
+		}
+		return bean.A
+	}
+	for i := 0; i < 2; i++ { // 第二次从缓存读取
+		for _, tenant := range tenants {
+			if a := get(tenant); a != tenant {
+				t.Errorf("tenant %s got %s", tenant, a)
+				t.FailNow()
+			}
+		}
+	}
+	for _, tenant := range tenants {
+		if keys := s.Keys(); !strings.Contains(strings.Join(keys, " "), "x_orm_sticky_bean@"+tenant) {
+			t.Errorf("no cache key for tenant %s: %v", tenant, keys)
+			t.FailNow()
+		}
+	}
+	if _, err := XOrmEngine("tenant_t1").ID(1).Update(&xOrmStickyBean{A: "updated"}); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if get("t1") != "updated" || get("t2") != "t2" {
+		t.Error("update of one tenant should only invalidate its own cache")
+	}
+}
+
+func TestXOrmRedisCacheClient(t *testing.T) {
+	s, client := redistest.New(t)
+	c, err := NewXOrmRedisCacheClient(client, time.Minute, XOrmRedisCacheIdsTTL(time.Second*10), XOrmRedisCacheLock(time.Millisecond*200))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer xOrmRedisCaches.Delete(c)
+	if c.addr != s.Addr()+"/0" {
+		t.Errorf("addr %s", c.addr)
+		t.FailNow()
+	}
+
+	bean := &xOrmTestBean{ID: 1, A: "a"}
+	c.PutBean("bean", "1", bean)
+	c.PutIds("bean", "select id", "ids")
+	if got := c.GetBean("bean", "1"); !reflect.DeepEqual(got, bean) {
+		t.Errorf("got %v", got)
+		t.FailNow()
+	}
+	if ttl := s.TTL(c.sqlKey("bean", "select id")); ttl != time.Second*10 {
+		t.Errorf("ids ttl %s", ttl)
+		t.FailNow()
+	}
+	s.FastForward(time.Second * 11)
+	if c.GetIds("bean", "select id") != nil || c.GetBean("bean", "1") == nil {
+		t.Error("ids not expired or bean expired")
+		t.FailNow()
+	}
+
+	// GetIds未命中后持有锁, 其他实例等待写入
+	other, err := NewXOrmRedisCacheClient(redis.NewClient(&redis.Options{Addr: s.Addr()}), time.Minute, XOrmRedisCacheLock(time.Millisecond*200))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer other.Close()
+	defer xOrmRedisCaches.Delete(other)
+	if c.GetIds("bean", "select id") != nil || !s.Exists(c.sqlKey("bean", "select id")+":lock") {
+		t.Error("lock not acquired")
+		t.FailNow()
+	}
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		c.PutIds("bean", "select id", "ids")
+	}()
+	if other.GetIds("bean", "select id") != "ids" {
+		t.Error("waiter did not get the value")
+		t.FailNow()
+	}
+	if s.Exists(c.sqlKey("bean", "select id") + ":lock") {
+		t.Error("lock not released")
+		t.FailNow()
+	}
+
+	for i := 0; i < xOrmCacheClearBatch+10; i++ {
+		c.PutBean("bean", strconv.Itoa(i), bean)
+	}
+	c.PutBean("other", "1", bean)
+	c.ClearBeans("bean")
+	if keys := s.Keys(); len(keys) != 2 {
+		t.Errorf("keys after clear %v", keys)
+		t.FailNow()
+	}
+	if stats := c.Stats()["bean"]; stats.Errors != 0 {
+		t.Errorf("stats %+v", stats)
+		t.FailNow()
+	}
+}